@@ -12,8 +12,8 @@ import (
 	"github.com/aofei/air"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog"
-	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -31,31 +31,54 @@ var (
 
 	// Cron is the global instance of the `cron.Cron`.
 	Cron *cron.Cron
+
+	// Tracer is the global instance of the `trace.Tracer`.
+	Tracer trace.Tracer
 )
 
 func init() {
-	cf := pflag.StringP("config", "c", "config.toml", "configuration file")
-	pflag.Parse()
-
-	ext := filepath.Ext(*cf)
-	Viper.AddConfigPath(filepath.Dir(*cf))
-	Viper.SetConfigName(strings.TrimSuffix(filepath.Base(*cf), ext))
-	Viper.SetConfigType(strings.TrimPrefix(ext, "."))
-	if err := Viper.ReadInConfig(); err != nil {
+	cf, cfRequired := configFile()
+	Viper.SetConfigFile(cf)
+	Viper.SetConfigType(strings.TrimPrefix(filepath.Ext(cf), "."))
+	b, err := readConfigFile(cfRequired)
+	if err != nil {
 		panic(fmt.Errorf("failed to read configuration file: %v", err))
 	}
 
+	if err := readConfig(Viper, b); err != nil {
+		panic(fmt.Errorf("failed to read configuration: %v", err))
+	}
+
+	if err := validateConfig(Viper); err != nil {
+		panic(fmt.Errorf("invalid configuration:\n%v", err))
+	}
+
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	Logger = Logger.With().
 		Str("app_name", Viper.GetString("air.app_name")).
 		Logger()
 	if Viper.GetBool("air.debug_mode") {
-		Logger = Logger.Level(zerolog.DebugLevel)
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
 		l, _ := zerolog.ParseLevel(Viper.GetString("zerolog.level"))
-		Logger = Logger.Level(l)
+		zerolog.SetGlobalLevel(l)
 	}
 
+	OnConfigReload([]string{"zerolog.level"}, func(
+		v *viper.Viper,
+	) (func(), error) {
+		l, err := zerolog.ParseLevel(v.GetString("zerolog.level"))
+		if err != nil {
+			return nil, err
+		}
+
+		return func() {
+			if !Viper.GetBool("air.debug_mode") {
+				zerolog.SetGlobalLevel(l)
+			}
+		}, nil
+	})
+
 	if err := Viper.UnmarshalKey("air", Air); err != nil {
 		Logger.Fatal().Err(err).
 			Msg("failed to unmarshal air configuration items")
@@ -71,8 +94,16 @@ func init() {
 			cron.PrintfLogger(log.New(Logger, "cron: ", 0)),
 		),
 	)
-	Cron.Start()
 	Air.AddShutdownJob(func() {
 		<-Cron.Stop().Done()
 	})
+
+	initTracing()
+}
+
+// Start starts the `Cron` and the configuration watcher, which are only needed
+// by a long-running process.
+func Start() {
+	Cron.Start()
+	watchConfig()
 }
@@ -0,0 +1,529 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configEnvPrefix is the prefix of the environment variables that override the
+// configuration items. For example, the "GOPROXYCN_GOPROXY_FETCH_TIMEOUT"
+// overrides the "goproxy.fetch_timeout". The longest of the `configSections`
+// that the rest of the name starts with (with its "." replaced by "_")
+// separates the section from the key.
+const configEnvPrefix = "GOPROXYCN_"
+
+// configFileEnv is the environment variable that names the configuration file
+// if the "--config" flag is not given.
+const configFileEnv = configEnvPrefix + "CONFIG"
+
+// configFileSuffix is the suffix of the keys of the configuration items that
+// name the files holding the secrets of the keys without it (e.g. the
+// "qiniu.secret_key_file" for the "qiniu.secret_key").
+const configFileSuffix = "_file"
+
+// configRedacted replaces the secrets in the `RedactedConfig`.
+const configRedacted = "<REDACTED>"
+
+// configSections is the sections of the configuration items. It does not
+// depend on the configuration file, which may not even exist.
+var configSections = []string{
+	"access_log",
+	"air",
+	"auth",
+	"config",
+	"goproxy",
+	"health",
+	"metrics",
+	"policy",
+	"qiniu",
+	"rate_limit",
+	"redirect",
+	"scrubber",
+	"stats",
+	"storage",
+	"storage.breaker",
+	"storage.retry",
+	"tracing",
+	"verification",
+	"warm",
+	"zerolog",
+}
+
+var (
+	// configFileRequired indicates whether the configuration file must
+	// exist. It is false if the default one is used.
+	configFileRequired bool
+
+	// configReloaders is the registered reloaders of the configuration
+	// items.
+	configReloaders []configReloader
+
+	// configReloadMutex is used to serialize the configuration reloads.
+	configReloadMutex sync.Mutex
+)
+
+// configReloader is a reloader of the configuration items of the keys.
+type configReloader struct {
+	keys    []string
+	prepare func(v *viper.Viper) (func(), error)
+}
+
+// matchKey reports whether the key is one of the `cr.keys` or under one of
+// them.
+func (cr configReloader) matchKey(key string) bool {
+	for _, k := range cr.keys {
+		if key == k || strings.HasPrefix(key, k+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OnConfigReload registers the prepare to be called with the reloaded
+// configuration when the configuration items of any of the keys (or under
+// them) change. The prepare validates the reloaded configuration and returns a
+// function that applies it, which is only called once all prepares succeed.
+//
+// Changes to the configuration items not registered by any call are rejected.
+func OnConfigReload(
+	keys []string,
+	prepare func(v *viper.Viper) (apply func(), err error),
+) {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+	configReloaders = append(configReloaders, configReloader{
+		keys:    keys,
+		prepare: prepare,
+	})
+}
+
+// ReloadConfig rereads the configuration file and applies the changed
+// configuration items to the `Viper` and their reloaders registered by the
+// `OnConfigReload`. Nothing is applied if any changed configuration item is
+// immutable or fails to be prepared.
+func ReloadConfig() error {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+
+	b, err := readConfigFile(configFileRequired)
+	if err != nil {
+		return err
+	}
+
+	v := viper.New()
+	v.SetConfigType(strings.TrimPrefix(
+		filepath.Ext(Viper.ConfigFileUsed()),
+		".",
+	))
+	if err := readConfig(v, b); err != nil {
+		return err
+	}
+
+	if err := validateConfig(v); err != nil {
+		return err
+	}
+
+	var (
+		changedKeys   []string
+		immutableKeys []string
+		reloads       = make([]bool, len(configReloaders))
+	)
+
+	for _, key := range configKeys(Viper, v) {
+		if reflect.DeepEqual(Viper.Get(key), v.Get(key)) {
+			continue
+		}
+
+		changedKeys = append(changedKeys, key)
+
+		mutable := false
+		for i, cr := range configReloaders {
+			if cr.matchKey(key) {
+				reloads[i], mutable = true, true
+			}
+		}
+
+		if !mutable {
+			immutableKeys = append(immutableKeys, key)
+		}
+	}
+
+	if len(immutableKeys) > 0 {
+		return fmt.Errorf(
+			"immutable configuration items changed: %s",
+			strings.Join(immutableKeys, ", "),
+		)
+	}
+
+	if len(changedKeys) == 0 {
+		return nil
+	}
+
+	var applies []func()
+	for i, cr := range configReloaders {
+		if !reloads[i] {
+			continue
+		}
+
+		apply, err := cr.prepare(v)
+		if err != nil {
+			return err
+		}
+
+		applies = append(applies, apply)
+	}
+
+	if err := readConfig(Viper, b); err != nil {
+		return err
+	}
+
+	for _, apply := range applies {
+		apply()
+	}
+
+	Logger.Info().Strs("keys", changedKeys).
+		Msg("reloaded configuration")
+
+	return nil
+}
+
+// configFile returns the name of the configuration file, which is given by the
+// "--config" flag, the `configFileEnv` or defaults to the "config.toml", and
+// reports whether it is required to exist (i.e. not the default one).
+//
+// The flag is registered to the `pflag.CommandLine` for the main package to
+// parse, as all packages are initialized before it. So it is looked up here by
+// a flag set that skips all other flags.
+func configFile() (string, bool) {
+	name, required := os.Getenv(configFileEnv), true
+	if name == "" {
+		name, required = "config.toml", false
+	}
+
+	const usage = "configuration file"
+	pflag.StringP("config", "c", name, usage)
+
+	flags := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+	cf := flags.StringP("config", "c", name, usage)
+	flags.Parse(os.Args[1:])
+	if flags.Changed("config") {
+		return *cf, true
+	}
+
+	return name, required
+}
+
+// readConfigFile reads the configuration file used by the `Viper`. An empty
+// configuration is returned if the file does not exist and is not required.
+func readConfigFile(required bool) ([]byte, error) {
+	configFileRequired = required
+
+	b, err := os.ReadFile(Viper.ConfigFileUsed())
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil, nil
+	}
+
+	return b, err
+}
+
+// readConfig reads the configuration in the b into the v and overlays it with
+// the environment variables prefixed with the `configEnvPrefix` and then the
+// secrets in the files named by the keys suffixed with the `configFileSuffix`.
+func readConfig(v *viper.Viper, b []byte) error {
+	if err := v.ReadConfig(bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	envOverlay := map[string]any{}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if name == configFileEnv {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(name, configEnvPrefix)
+		if !ok || name == "" {
+			continue
+		}
+
+		key, err := configEnvKey(name)
+		if err != nil {
+			return err
+		}
+
+		setConfigOverlay(envOverlay, key, value)
+	}
+
+	if err := v.MergeConfigMap(envOverlay); err != nil {
+		return err
+	}
+
+	fileOverlay := map[string]any{}
+	for _, key := range v.AllKeys() {
+		secretKey, ok := strings.CutSuffix(key, configFileSuffix)
+		if !ok || !isSecretConfigKey(secretKey) {
+			continue
+		}
+
+		filename := v.GetString(key)
+		if filename == "" {
+			continue
+		}
+
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+
+		setConfigOverlay(
+			fileOverlay,
+			secretKey,
+			strings.TrimRight(string(b), "\r\n"),
+		)
+	}
+
+	return v.MergeConfigMap(fileOverlay)
+}
+
+// configEnvKey returns the key of the configuration item overridden by the
+// environment variable of the name without the `configEnvPrefix`.
+func configEnvKey(name string) (string, error) {
+	var section string
+	for _, s := range configSections {
+		prefix := strings.ToUpper(strings.ReplaceAll(s, ".", "_")) + "_"
+		if len(s) > len(section) &&
+			len(name) > len(prefix) &&
+			strings.HasPrefix(name, prefix) {
+			section = s
+		}
+	}
+
+	if section == "" {
+		return "", fmt.Errorf(
+			"unknown configuration section of %s%s",
+			configEnvPrefix,
+			name,
+		)
+	}
+
+	return section + "." + strings.ToLower(name[len(section)+1:]), nil
+}
+
+// setConfigOverlay sets the value of the key in the overlay, creating the
+// nested maps of the key as needed.
+func setConfigOverlay(overlay map[string]any, key string, value any) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		m, ok := overlay[part].(map[string]any)
+		if !ok {
+			m = map[string]any{}
+			overlay[part] = m
+		}
+
+		overlay = m
+	}
+
+	overlay[parts[len(parts)-1]] = value
+}
+
+// validateConfig validates the configuration items in the v. All problems are
+// reported at once.
+func validateConfig(v *viper.Viper) error {
+	var errs []error
+
+	if _, err := zerolog.ParseLevel(
+		v.GetString("zerolog.level"),
+	); err != nil {
+		errs = append(errs, fmt.Errorf(
+			"invalid zerolog.level: %w",
+			err,
+		))
+	}
+
+	fetchTimeout := v.GetString("goproxy.fetch_timeout")
+	if fetchTimeout != "" {
+		if _, err := time.ParseDuration(fetchTimeout); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"invalid goproxy.fetch_timeout: %w",
+				err,
+			))
+		}
+	}
+
+	var endpointKey string
+	switch backend := v.GetString("storage.backend"); backend {
+	case "", "kodo":
+		endpointKey = "qiniu.kodo_endpoint"
+	case "s3":
+		endpointKey = "storage.s3_endpoint"
+	case "filesystem":
+		if v.GetString("storage.filesystem_root") == "" {
+			errs = append(errs, errors.New(
+				"missing storage.filesystem_root",
+			))
+		}
+	default:
+		errs = append(errs, fmt.Errorf(
+			"unknown storage.backend: %q",
+			backend,
+		))
+	}
+
+	if endpointKey != "" {
+		endpoint := v.GetString(endpointKey)
+		if u, err := url.Parse(endpoint); endpoint == "" {
+			errs = append(errs, errors.New("missing "+endpointKey))
+		} else if err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf(
+				"invalid %s: %q",
+				endpointKey,
+				endpoint,
+			))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isSecretConfigKey reports whether the key is of a secret configuration item.
+// The keys suffixed with the `configFileSuffix` are not, as they only name the
+// files.
+func isSecretConfigKey(key string) bool {
+	key = key[strings.LastIndex(key, ".")+1:]
+	return !strings.HasSuffix(key, configFileSuffix) &&
+		(strings.Contains(key, "secret") ||
+			strings.Contains(key, "password") ||
+			strings.Contains(key, "token") ||
+			strings.HasSuffix(key, "access_key") ||
+			strings.HasSuffix(key, "sign_key"))
+}
+
+// SubViper is like the `Viper.Sub`, but returns an empty instance instead of
+// nil if the key is not found.
+func SubViper(key string) *viper.Viper {
+	if v := Viper.Sub(key); v != nil {
+		return v
+	}
+
+	return viper.New()
+}
+
+// RedactedConfig returns the effective configuration items of the `Viper` with
+// the secrets redacted.
+func RedactedConfig() map[string]any {
+	return redactConfig(Viper.AllSettings()).(map[string]any)
+}
+
+// redactConfig returns a copy of the settings with the secrets redacted.
+func redactConfig(settings any) any {
+	switch settings := settings.(type) {
+	case map[string]any:
+		redacted := make(map[string]any, len(settings))
+		for key, value := range settings {
+			if isSecretConfigKey(key) && value != "" {
+				redacted[key] = configRedacted
+			} else {
+				redacted[key] = redactConfig(value)
+			}
+		}
+
+		return redacted
+	case []map[string]any:
+		redacted := make([]any, 0, len(settings))
+		for _, value := range settings {
+			redacted = append(redacted, redactConfig(value))
+		}
+
+		return redacted
+	case []any:
+		redacted := make([]any, 0, len(settings))
+		for _, value := range settings {
+			redacted = append(redacted, redactConfig(value))
+		}
+
+		return redacted
+	}
+
+	return settings
+}
+
+// configKeys returns the sorted union of the keys of the configuration items
+// in the vipers.
+func configKeys(vipers ...*viper.Viper) []string {
+	var keys []string
+	for _, v := range vipers {
+		keys = append(keys, v.AllKeys()...)
+	}
+
+	slices.Sort(keys)
+
+	return slices.Compact(keys)
+}
+
+// watchConfig reloads the configuration on SIGHUP and, if enabled, whenever the
+// configuration file changes.
+func watchConfig() {
+	reload := func() {
+		if err := ReloadConfig(); err != nil {
+			Logger.Error().Err(err).
+				Msg("failed to reload configuration")
+		}
+	}
+
+	sighupChan := make(chan os.Signal, 1)
+	signal.Notify(sighupChan, syscall.SIGHUP)
+	go func() {
+		for range sighupChan {
+			reload()
+		}
+	}()
+
+	if !Viper.GetBool("config.watch_enabled") {
+		return
+	}
+
+	if _, err := os.Stat(Viper.ConfigFileUsed()); err != nil {
+		Logger.Fatal().Err(err).
+			Msg("failed to stat configuration file to watch")
+	}
+
+	// A separate instance is watched so that the rejected changes never
+	// reach the `Viper`.
+	watcher := viper.New()
+	watcher.SetConfigFile(Viper.ConfigFileUsed())
+	watcher.SetConfigType(strings.TrimPrefix(
+		filepath.Ext(Viper.ConfigFileUsed()),
+		".",
+	))
+	if err := watcher.ReadInConfig(); err != nil {
+		Logger.Fatal().Err(err).
+			Msg("failed to read configuration file to watch")
+	}
+
+	watcher.OnConfigChange(func(fsnotify.Event) {
+		reload()
+	})
+	watcher.WatchConfig()
+}
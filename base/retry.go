@@ -3,7 +3,20 @@ package base
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
 	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ErrRetryable means an operation is retryable.
@@ -22,6 +35,269 @@ func (RetryableError) Is(target error) bool {
 	return target == ErrRetryable
 }
 
+// RetryAfterError is an error indicating that an operation should not be
+// retried before the After (e.g. from the "Retry-After" header).
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+// Error implements the `error`.
+func (rae *RetryAfterError) Error() string {
+	return rae.Err.Error()
+}
+
+// Unwrap returns the `rae.Err`.
+func (rae *RetryAfterError) Unwrap() error {
+	return rae.Err
+}
+
+// ParseRetryAfter parses the value of the "Retry-After" header, which is either
+// a number of seconds or an HTTP date. It returns zero if the value is invalid.
+func ParseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+
+	return 0
+}
+
+// The classes of the retryable errors.
+const (
+	// RetryClassRetryable is the class of the `ErrRetryable`.
+	RetryClassRetryable = "retryable"
+
+	// RetryClassNetwork is the class of the transient network errors.
+	RetryClassNetwork = "network"
+
+	// RetryClassServer is the class of the server errors (e.g. 5xx).
+	RetryClassServer = "server"
+
+	// RetryClassThrottle is the class of the throttling errors (e.g. 429).
+	RetryClassThrottle = "throttle"
+)
+
+// ClassifyNetworkError returns the `RetryClassNetwork` if the err is a
+// transient network error, otherwise "".
+func ClassifyNetworkError(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return ""
+	case errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return RetryClassNetwork
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return RetryClassNetwork
+	}
+
+	return ""
+}
+
+// ClassifyHTTPStatusCode returns the `RetryClassThrottle` for the 429 and the
+// `RetryClassServer` for the 5xx status codes, otherwise "".
+func ClassifyHTTPStatusCode(statusCode int) string {
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return RetryClassThrottle
+	case statusCode >= 500 && statusCode < 600:
+		return RetryClassServer
+	}
+
+	return ""
+}
+
+// RetryPolicy is a policy of retrying operations. There is an exponentially
+// growing nap before each retry.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. It is at least 1.
+	MaxAttempts int
+
+	// InitialInterval is the nap before the first retry.
+	InitialInterval time.Duration
+
+	// MaxInterval is the maximum nap. Zero means unlimited.
+	MaxInterval time.Duration
+
+	// Multiplier is the factor by which the nap grows after each retry.
+	// Values below 1 are taken as 1, which keeps the nap fixed.
+	Multiplier float64
+
+	// Jitter indicates whether each nap is randomized between zero and
+	// its full length, which spreads out the retries of many callers.
+	Jitter bool
+
+	// MaxElapsedTime is the maximum time since the first attempt after
+	// which there is no retry. Zero means unlimited.
+	MaxElapsedTime time.Duration
+
+	// Classify returns the class of the err if it is retryable, otherwise
+	// "". The `ErrRetryable` is always of the `RetryClassRetryable`.
+	Classify func(err error) string
+}
+
+// RetryStats is the stats of an operation done by the `RetryPolicy.Do`.
+type RetryStats struct {
+	// Attempts is the number of attempts.
+	Attempts int
+
+	// Elapsed is the time taken by all attempts and naps.
+	Elapsed time.Duration
+
+	// Retries is the number of retries by the class of the errors that
+	// caused them.
+	Retries map[string]int
+}
+
+// Do does the f, and retries it based on the rp. Each attempt is traced as a
+// span. The err is the one of the last attempt.
+func (rp RetryPolicy) Do(
+	ctx context.Context,
+	f func(ctx context.Context) error,
+) (stats RetryStats, err error) {
+	startTime := time.Now()
+	defer func() {
+		stats.Elapsed = time.Since(startTime)
+	}()
+
+	for nap := rp.InitialInterval; ; nap = rp.nextNap(nap) {
+		stats.Attempts++
+
+		attemptCtx, span := Tracer.Start(
+			ctx,
+			"attempt",
+			trace.WithAttributes(
+				attribute.Int("retry.attempt", stats.Attempts),
+			),
+		)
+		if err = f(attemptCtx); err == nil {
+			span.End()
+			return stats, nil
+		}
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		class := rp.classify(err)
+		if class == "" || stats.Attempts >= max(rp.MaxAttempts, 1) {
+			span.End()
+			return stats, err
+		}
+
+		wait := nap
+		if rp.Jitter {
+			wait = time.Duration(rand.Int64N(int64(wait) + 1))
+		}
+
+		var rae *RetryAfterError
+		if errors.As(err, &rae) {
+			wait = max(wait, rae.After)
+		}
+
+		if rp.MaxElapsedTime > 0 &&
+			time.Since(startTime)+wait > rp.MaxElapsedTime {
+			span.End()
+			return stats, err
+		}
+
+		span.SetAttributes(
+			attribute.String("retry.class", class),
+			attribute.String("retry.reason", err.Error()),
+			attribute.Int64("retry.nap_ms", wait.Milliseconds()),
+		)
+		span.End()
+
+		if stats.Retries == nil {
+			stats.Retries = map[string]int{}
+		}
+
+		stats.Retries[class]++
+
+		select {
+		case <-ctx.Done():
+			return stats, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// classify returns the class of the err based on the `rp.Classify`.
+func (rp RetryPolicy) classify(err error) string {
+	if errors.Is(err, ErrRetryable) {
+		return RetryClassRetryable
+	} else if rp.Classify == nil {
+		return ""
+	}
+
+	return rp.Classify(err)
+}
+
+// nextNap returns the nap that follows the nap, before any jitter.
+func (rp RetryPolicy) nextNap(nap time.Duration) time.Duration {
+	next := time.Duration(float64(nap) * max(rp.Multiplier, 1))
+	if next < nap || next > math.MaxInt64/2 {
+		next = math.MaxInt64 / 2 // Overflowed
+	}
+
+	if rp.MaxInterval > 0 {
+		next = min(next, rp.MaxInterval)
+	}
+
+	return next
+}
+
+// WithConfig returns a copy of the rp with the fields overridden by the
+// configuration items in the v (e.g. the "max_attempts" and the
+// "initial_interval") that are set.
+func (rp RetryPolicy) WithConfig(v *viper.Viper) (RetryPolicy, error) {
+	if v.IsSet("max_attempts") {
+		rp.MaxAttempts = v.GetInt("max_attempts")
+	}
+
+	for key, d := range map[string]*time.Duration{
+		"initial_interval": &rp.InitialInterval,
+		"max_interval":     &rp.MaxInterval,
+		"max_elapsed_time": &rp.MaxElapsedTime,
+	} {
+		if !v.IsSet(key) {
+			continue
+		}
+
+		var err error
+		*d, err = time.ParseDuration(v.GetString(key))
+		if err != nil {
+			return RetryPolicy{}, fmt.Errorf(
+				"invalid %s: %w",
+				key,
+				err,
+			)
+		}
+	}
+
+	if v.IsSet("multiplier") {
+		rp.Multiplier = v.GetFloat64("multiplier")
+	}
+
+	if v.IsSet("jitter") {
+		rp.Jitter = v.GetBool("jitter")
+	}
+
+	return rp, nil
+}
+
 // Retry is like the `RetryN`, but at most 100 million retries.
 func Retry(
 	ctx context.Context,
@@ -33,7 +309,7 @@ func Retry(
 }
 
 // RetryN retries the f based on the retryable at most n times. And there is a
-// nap before each retry.
+// fixed nap before each retry.
 func RetryN(
 	ctx context.Context,
 	f func(ctx context.Context) error,
@@ -41,24 +317,16 @@ func RetryN(
 	nap time.Duration,
 	n int,
 ) error {
-	if retryable == nil {
-		retryable = func(_ error) bool { return false }
-	}
-	n = max(n, 1)
-
-	var err error
-	for range n {
-		if err = f(ctx); err == nil {
-			return nil
-		} else if !errors.Is(err, ErrRetryable) && !retryable(err) {
-			return err
-		}
+	_, err := RetryPolicy{
+		MaxAttempts:     n,
+		InitialInterval: nap,
+		Classify: func(err error) string {
+			if retryable != nil && retryable(err) {
+				return RetryClassRetryable
+			}
 
-		select {
-		case <-ctx.Done():
-			return err
-		case <-time.After(nap):
-		}
-	}
+			return ""
+		},
+	}.Do(ctx, f)
 	return err
 }
@@ -0,0 +1,103 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// tracerName is the name of the `Tracer`.
+const tracerName = "github.com/goproxy/goproxy.cn"
+
+// initTracing initializes the `Tracer` based on the configuration items of the
+// tracing. The `Tracer` is a no-op one if the tracing is disabled.
+func initTracing() {
+	Tracer = otel.Tracer(tracerName)
+	if !Viper.GetBool("tracing.enabled") {
+		return
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch e := Viper.GetString("tracing.exporter"); e {
+	case "", "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint := Viper.GetString(
+			"tracing.otlp_endpoint",
+		); endpoint != "" {
+			opts = append(
+				opts,
+				otlptracehttp.WithEndpointURL(endpoint),
+			)
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(
+			stdouttrace.WithWriter(os.Stdout),
+		)
+	default:
+		err = fmt.Errorf("unknown tracing exporter: %q", e)
+	}
+
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("failed to create tracing exporter")
+	}
+
+	serviceName := Viper.GetString("tracing.service_name")
+	if serviceName == "" {
+		serviceName = Viper.GetString("air.app_name")
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+	))
+	if err != nil {
+		Logger.Fatal().Err(err).Msg("failed to create tracing resource")
+	}
+
+	sampleRatio := 1.0
+	if Viper.IsSet("tracing.sample_ratio") {
+		sampleRatio = Viper.GetFloat64("tracing.sample_ratio")
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(sampleRatio),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	Tracer = tp.Tracer(tracerName)
+
+	Air.AddShutdownJob(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			10*time.Second,
+		)
+		defer cancel()
+
+		if err := tp.Shutdown(ctx); err != nil {
+			Logger.Error().Err(err).
+				Msg("failed to shut down tracer provider")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/goproxy/goproxy.cn/handler"
+)
+
+// commandUsage is the usage of the commands.
+const commandUsage = `usage:
+	cache ls <module>
+	cache stat <name>
+	cache purge <module>[@<version>]
+	cache warm <module>@<version>|<go.mod>|<go.sum>|<list>|-...
+	cache verify [<module>]
+	cache backfill-checksums [<module>]
+	takedown <module>[@<version>] [<reason>]
+	config`
+
+// runCommand runs the command described by the args.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "cache":
+		return runCacheCommand(args[1:])
+	case "takedown":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New(commandUsage)
+		}
+
+		modulePath, moduleVersion, _ := strings.Cut(args[1], "@")
+
+		var reason string
+		if len(args) > 2 {
+			reason = args[2]
+		}
+
+		return handler.Takedown(
+			base.Context,
+			modulePath,
+			moduleVersion,
+			reason,
+		)
+	case "config":
+		if len(args) != 1 {
+			return errors.New(commandUsage)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "\t")
+
+		return encoder.Encode(base.RedactedConfig())
+	}
+
+	return errors.New(commandUsage)
+}
+
+// runCacheCommand runs the cache command described by the args.
+func runCacheCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(commandUsage)
+	}
+
+	switch subcommand, args := args[0], args[1:]; {
+	case subcommand == "ls" && len(args) == 1:
+		return handler.ListCache(base.Context, os.Stdout, args[0])
+	case subcommand == "stat" && len(args) == 1:
+		return handler.StatCache(base.Context, os.Stdout, args[0])
+	case subcommand == "purge" && len(args) == 1:
+		modulePath, moduleVersion, _ := strings.Cut(args[0], "@")
+		return handler.PurgeCache(
+			base.Context,
+			modulePath,
+			moduleVersion,
+		)
+	case subcommand == "warm" && len(args) > 0:
+		var targets []handler.WarmTarget
+		for _, arg := range args {
+			var (
+				b   []byte
+				err error
+			)
+
+			switch {
+			case strings.Contains(arg, "@"):
+				b = []byte(arg)
+			case arg == "-":
+				b, err = io.ReadAll(os.Stdin)
+			default:
+				b, err = os.ReadFile(arg)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			argTargets, err := handler.ParseWarmTargets(b)
+			if err != nil {
+				return err
+			}
+
+			targets = append(targets, argTargets...)
+		}
+
+		return handler.WarmCache(base.Context, os.Stdout, targets)
+	case subcommand == "verify" && len(args) <= 1:
+		var modulePath string
+		if len(args) > 0 {
+			modulePath = args[0]
+		}
+
+		return handler.VerifyCache(base.Context, os.Stdout, modulePath)
+	case subcommand == "backfill-checksums" && len(args) <= 1:
+		var modulePath string
+		if len(args) > 0 {
+			modulePath = args[0]
+		}
+
+		return handler.BackfillCacheChecksums(
+			base.Context,
+			os.Stdout,
+			modulePath,
+		)
+	}
+
+	return fmt.Errorf("invalid cache command\n%s", commandUsage)
+}
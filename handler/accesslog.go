@@ -0,0 +1,530 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// accessLogsPrefix is the prefix of the names of the access log objects written
+// by the `storageAccessLogWriter` in the `objectStorage`.
+const accessLogsPrefix = "accesslogs/"
+
+// The cache outcomes of the requests to the Go module proxy.
+const (
+	// accessLogCacheOutcomeHit means the request is served from the cache.
+	accessLogCacheOutcomeHit = "hit"
+
+	// accessLogCacheOutcomeMiss means the request misses the cache and is
+	// served by an upstream fetch.
+	accessLogCacheOutcomeMiss = "miss"
+
+	// accessLogCacheOutcomeRedirect means the request is redirected to
+	// the object in the `objectStorage` (e.g. a presigned URL).
+	accessLogCacheOutcomeRedirect = "redirect"
+
+	// accessLogCacheOutcomeNegative means the request misses the cache and
+	// the upstream fetch finds nothing.
+	accessLogCacheOutcomeNegative = "negative"
+)
+
+var (
+	// accessLogSink is the sink of the sampled access logs. It is nil if
+	// disabled.
+	accessLogSink *zerolog.Logger
+
+	// accessLogSampleRate is the fraction of the requests written to the
+	// `accessLogSink`.
+	accessLogSampleRate = newReloadable(0.0)
+)
+
+func init() {
+	var w io.Writer
+	switch sink := base.Viper.GetString("access_log.sink"); sink {
+	case "":
+		return
+	case "file":
+		maxBytes := base.Viper.GetInt64("access_log.file_max_bytes")
+		if maxBytes <= 0 {
+			maxBytes = 100 << 20
+		}
+
+		rf, err := newRotatingFile(
+			base.Viper.GetString("access_log.file_path"),
+			maxBytes,
+			base.Viper.GetInt("access_log.file_max_backups"),
+		)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to open access log file")
+		}
+
+		w = rf
+	case "storage":
+		w = newStorageAccessLogWriter()
+	default:
+		base.Logger.Fatal().Str("sink", sink).
+			Msg("unknown access log sink")
+	}
+
+	sinkLogger := zerolog.New(w)
+	accessLogSink = &sinkLogger
+
+	loadAccessLogConfig(base.Viper)()
+	base.OnConfigReload([]string{"access_log.sample_rate"}, func(
+		v *viper.Viper,
+	) (func(), error) {
+		return loadAccessLogConfig(v), nil
+	})
+}
+
+// loadAccessLogConfig loads the configuration items of the access logs from the
+// v and returns a function that applies them.
+func loadAccessLogConfig(v *viper.Viper) func() {
+	sampleRate := v.GetFloat64("access_log.sample_rate")
+	return func() {
+		accessLogSampleRate.Store(sampleRate)
+	}
+}
+
+// AccessLogGas is used to log every request, along with the details recorded
+// in its `accessLogEntry` while serving it. The sampled ones are also written
+// to the `accessLogSink` (if any).
+func AccessLogGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) (err error) {
+		ale := &accessLogEntry{startTime: time.Now()}
+		req.Context = context.WithValue(
+			req.Context,
+			accessLogEntryContextKey{},
+			ale,
+		)
+
+		res.Defer(func() {
+			alr := ale.record(req, res)
+			base.Logger.Err(err).EmbedObject(alr).Msg("")
+
+			if accessLogSink == nil ||
+				!sampleAccessLog(accessLogSampleRate.Load()) {
+				return
+			}
+
+			accessLogSink.Err(err).EmbedObject(alr).Msg("")
+		})
+
+		return next(req, res)
+	}
+}
+
+// sampleAccessLog reports whether to sample an access log at the sampleRate.
+func sampleAccessLog(sampleRate float64) bool {
+	return mathrand.Float64() < sampleRate
+}
+
+// accessLogEntryContextKey is the context key of the `accessLogEntry`.
+type accessLogEntryContextKey struct{}
+
+// accessLogEntry is the details of a request recorded while serving it. All of
+// its methods do nothing if it is nil.
+type accessLogEntry struct {
+	startTime time.Time
+
+	mutex          sync.Mutex
+	modulePath     string
+	moduleVersion  string
+	fileKind       string
+	cacheOutcome   string
+	fetchStartTime time.Time
+	fetchDuration  time.Duration
+	storageRetries int
+}
+
+// accessLogEntryFromContext returns the `accessLogEntry` in the ctx, or nil if
+// not found.
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	ale, _ := ctx.Value(accessLogEntryContextKey{}).(*accessLogEntry)
+	return ale
+}
+
+// setName sets the module path, module version and file kind of the ale from
+// the name of a request to the Go module proxy.
+func (ale *accessLogEntry) setName(name string) {
+	if ale == nil {
+		return
+	}
+
+	modulePath, moduleVersion, fileKind := parseGoproxyRequestName(name)
+
+	ale.mutex.Lock()
+	defer ale.mutex.Unlock()
+
+	ale.modulePath = modulePath
+	ale.moduleVersion = moduleVersion
+	ale.fileKind = fileKind
+}
+
+// setCacheOutcome sets the cache outcome of the ale. Only the first one is
+// kept.
+func (ale *accessLogEntry) setCacheOutcome(cacheOutcome string) {
+	if ale == nil {
+		return
+	}
+
+	ale.mutex.Lock()
+	defer ale.mutex.Unlock()
+	if ale.cacheOutcome == "" {
+		ale.cacheOutcome = cacheOutcome
+	}
+}
+
+// startFetch records the start of the upstream fetch of the ale.
+func (ale *accessLogEntry) startFetch() {
+	if ale == nil {
+		return
+	}
+
+	ale.mutex.Lock()
+	defer ale.mutex.Unlock()
+	if ale.fetchStartTime.IsZero() {
+		ale.fetchStartTime = time.Now()
+	}
+}
+
+// endFetch records the end of the upstream fetch of the ale, which is when its
+// first result is cached.
+func (ale *accessLogEntry) endFetch() {
+	if ale == nil {
+		return
+	}
+
+	ale.mutex.Lock()
+	defer ale.mutex.Unlock()
+	if !ale.fetchStartTime.IsZero() && ale.fetchDuration == 0 {
+		ale.fetchDuration = time.Since(ale.fetchStartTime)
+	}
+}
+
+// addStorageRetries records the n retries of an `objectStorage` operation of
+// the ale.
+func (ale *accessLogEntry) addStorageRetries(n int) {
+	if ale == nil || n <= 0 {
+		return
+	}
+
+	ale.mutex.Lock()
+	defer ale.mutex.Unlock()
+	ale.storageRetries += n
+}
+
+// record returns the `accessLogRecord` of the req served with the res.
+func (ale *accessLogEntry) record(
+	req *air.Request,
+	res *air.Response,
+) accessLogRecord {
+	endTime := time.Now()
+
+	ale.mutex.Lock()
+	defer ale.mutex.Unlock()
+
+	alr := accessLogRecord{
+		RemoteAddress:  req.RemoteAddress(),
+		ClientAddress:  req.ClientAddress(),
+		Method:         req.Method,
+		Path:           req.Path,
+		BytesIn:        req.ContentLength,
+		BytesOut:       res.ContentLength,
+		Status:         res.Status,
+		StartTime:      ale.startTime,
+		EndTime:        endTime,
+		Latency:        endTime.Sub(ale.startTime),
+		ModulePath:     ale.modulePath,
+		ModuleVersion:  ale.moduleVersion,
+		FileKind:       ale.fileKind,
+		CacheOutcome:   ale.cacheOutcome,
+		FetchDuration:  ale.fetchDuration,
+		StorageRetries: ale.storageRetries,
+	}
+
+	if sc := trace.SpanContextFromContext(req.Context); sc.IsValid() {
+		alr.TraceID = sc.TraceID().String()
+	}
+
+	if alr.CacheOutcome == "" && !ale.fetchStartTime.IsZero() {
+		switch res.Status {
+		case http.StatusNotFound, http.StatusGone:
+			alr.CacheOutcome = accessLogCacheOutcomeNegative
+		default:
+			alr.CacheOutcome = accessLogCacheOutcomeMiss
+		}
+	}
+
+	return alr
+}
+
+// accessLogRecord is a record of the access logs.
+type accessLogRecord struct {
+	RemoteAddress  string
+	ClientAddress  string
+	Method         string
+	Path           string
+	BytesIn        int64
+	BytesOut       int64
+	Status         int
+	StartTime      time.Time
+	EndTime        time.Time
+	Latency        time.Duration
+	ModulePath     string
+	ModuleVersion  string
+	FileKind       string
+	CacheOutcome   string
+	FetchDuration  time.Duration
+	StorageRetries int
+	TraceID        string
+}
+
+// MarshalZerologObject implements the `zerolog.LogObjectMarshaler`.
+func (alr accessLogRecord) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("remote_address", alr.RemoteAddress).
+		Str("client_address", alr.ClientAddress).
+		Str("method", alr.Method).
+		Str("path", alr.Path).
+		Int64("bytes_in", alr.BytesIn).
+		Int64("bytes_out", alr.BytesOut).
+		Int("status", alr.Status).
+		Time("start_time", alr.StartTime).
+		Time("end_time", alr.EndTime).
+		Dur("latency", alr.Latency)
+
+	if alr.TraceID != "" {
+		e.Str("trace_id", alr.TraceID)
+	}
+
+	if alr.FileKind == "" {
+		return
+	}
+
+	e.Str("file_kind", alr.FileKind)
+	if alr.ModulePath != "" {
+		e.Str("module_path", alr.ModulePath)
+	}
+
+	if alr.ModuleVersion != "" {
+		e.Str("module_version", alr.ModuleVersion)
+	}
+
+	if alr.CacheOutcome != "" {
+		e.Str("cache_outcome", alr.CacheOutcome)
+	}
+
+	if alr.FetchDuration > 0 {
+		e.Dur("fetch_duration", alr.FetchDuration)
+	}
+
+	if alr.StorageRetries > 0 {
+		e.Int("storage_retries", alr.StorageRetries)
+	}
+}
+
+// rotatingFile is a file that is rotated once it grows beyond its maximum size.
+// Its backups are named after it with the ".1" (newest) to ".N" suffixes.
+type rotatingFile struct {
+	name       string
+	maxBytes   int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// newRotatingFile returns a new instance of the `rotatingFile` with the name,
+// maxBytes and maxBackups.
+func newRotatingFile(
+	name string,
+	maxBytes int64,
+	maxBackups int,
+) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		name:       name,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// Write implements the `io.Writer`.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+// open opens the file of the rf for appending.
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(
+		rf.name,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0o644,
+	)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = fileInfo.Size()
+
+	return nil
+}
+
+// rotate shifts the backups of the rf, drops the oldest one and starts a new
+// file.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(
+			fmt.Sprint(rf.name, ".", i),
+			fmt.Sprint(rf.name, ".", i+1),
+		); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	var err error
+	if rf.maxBackups > 0 {
+		err = os.Rename(rf.name, rf.name+".1")
+	} else {
+		err = os.Remove(rf.name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// storageAccessLogWriter is used to buffer the access logs and flush them into
+// the JSON Lines objects in the `objectStorage`.
+type storageAccessLogWriter struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+// storageAccessLogWriterMaxBufferBytes is the maximum size of the buffer of
+// the `storageAccessLogWriter`. The access logs beyond it are dropped until the
+// next flush.
+const storageAccessLogWriterMaxBufferBytes = 64 << 20
+
+// newStorageAccessLogWriter returns a new instance of the
+// `storageAccessLogWriter` that is flushed every minute and on shutdown once
+// the handlers are started.
+func newStorageAccessLogWriter() *storageAccessLogWriter {
+	salw := &storageAccessLogWriter{}
+	onStart(salw.start)
+	return salw
+}
+
+// start starts flushing the salw every minute and on shutdown.
+func (salw *storageAccessLogWriter) start() {
+	if _, err := base.Cron.AddJob(
+		"* * * * *", // Every minute
+		cron.NewChain(
+			cron.SkipIfStillRunning(cron.DiscardLogger),
+		).Then(cron.FuncJob(func() {
+			if err := salw.flush(base.Context); err != nil {
+				base.Logger.Error().Err(err).
+					Msg("failed to flush access logs")
+			}
+		})),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add access log flush cron job")
+	}
+
+	base.Air.AddShutdownJob(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Minute,
+		)
+		defer cancel()
+
+		if err := salw.flush(ctx); err != nil {
+			base.Logger.Error().Err(err).
+				Msg("failed to flush access logs")
+		}
+	})
+}
+
+// Write implements the `io.Writer`.
+func (salw *storageAccessLogWriter) Write(b []byte) (int, error) {
+	salw.mutex.Lock()
+	defer salw.mutex.Unlock()
+	if salw.buffer.Len()+len(b) <= storageAccessLogWriterMaxBufferBytes {
+		salw.buffer.Write(b)
+	}
+
+	return len(b), nil
+}
+
+// flush flushes the buffered access logs of the salw into a new object in the
+// `objectStorage`. The access logs that failed to be flushed are dropped.
+func (salw *storageAccessLogWriter) flush(ctx context.Context) error {
+	salw.mutex.Lock()
+	b := bytes.Clone(salw.buffer.Bytes())
+	salw.buffer.Reset()
+	salw.mutex.Unlock()
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return objectStorage.Put(ctx, fmt.Sprint(
+		accessLogsPrefix,
+		time.Now().UTC().Format(time.DateOnly),
+		"/",
+		time.Now().UnixNano(),
+		"-",
+		hex.EncodeToString(id),
+		".jsonl",
+	), bytes.NewReader(b))
+}
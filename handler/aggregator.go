@@ -0,0 +1,735 @@
+package handler
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// statRecordsPrefix is the object name prefix of the module download
+	// records that have not yet been aggregated.
+	statRecordsPrefix = "stats/records/"
+
+	// statDailiesPrefix is the object name prefix of the daily module
+	// download counts used to generate the stat trends.
+	statDailiesPrefix = "stats/dailies/"
+
+	// downloadCountBadgeSuffix is the object name suffix of the download
+	// count badges.
+	downloadCountBadgeSuffix = "/badges/download-count.svg"
+)
+
+var (
+	// statsViper is used to get the configuration items of the stats.
+	statsViper = base.SubViper("stats")
+
+	// statsAggregationEnabled indicates whether the stats aggregation is
+	// enabled. Note that it should be enabled on only one instance.
+	statsAggregationEnabled = statsViper.GetBool("aggregation_enabled")
+
+	// moduleDownloads is the module downloads that have not yet been
+	// flushed.
+	moduleDownloads = map[moduleDownload]int{}
+
+	// moduleDownloadsMutex is the `sync.Mutex` for the `moduleDownloads`.
+	moduleDownloadsMutex sync.Mutex
+)
+
+// moduleDownload is a module download.
+type moduleDownload struct {
+	Date          string
+	ModulePath    string
+	ModuleVersion string
+}
+
+// moduleDownloadRecord is a module download record.
+type moduleDownloadRecord struct {
+	ModulePath    string `json:"module_path"`
+	ModuleVersion string `json:"module_version"`
+	DownloadCount int    `json:"download_count"`
+}
+
+// moduleDownloadCount is the download count of a module.
+type moduleDownloadCount struct {
+	ModulePath    string `json:"module_path"`
+	DownloadCount int    `json:"download_count"`
+}
+
+// statSummary is the stat summary.
+type statSummary struct {
+	CacherSize         int64                          `json:"cacher_size"`
+	ModuleVersionCount int                            `json:"module_version_count"`
+	ModuleHostCount    int                            `json:"module_host_count"`
+	Top10ModuleHosts   []moduleHostModuleVersionCount `json:"top_10_module_hosts"`
+}
+
+// statDaily is the daily module download counts.
+type statDaily struct {
+	DownloadCounts map[string]int     `json:"download_counts"`
+	AppliedRecords statAppliedRecords `json:"applied_records,omitempty"`
+}
+
+// statAppliedRecords is the names of the module download records that have
+// been applied to a stat object, which keeps a retried aggregation from
+// applying them twice.
+type statAppliedRecords []string
+
+// set returns the sar as a set.
+func (sar statAppliedRecords) set() map[string]bool {
+	set := make(map[string]bool, len(sar))
+	for _, recordName := range sar {
+		set[recordName] = true
+	}
+
+	return set
+}
+
+// add adds the recordNames of the date to the sar. Those of the dates before
+// the date are dropped, as they have all been aggregated.
+func (sar *statAppliedRecords) add(date string, recordNames ...string) {
+	*sar = slices.DeleteFunc(*sar, func(recordName string) bool {
+		return statRecordDate(recordName) < date
+	})
+
+	applied := sar.set()
+	for _, recordName := range recordNames {
+		if !applied[recordName] {
+			applied[recordName] = true
+			*sar = append(*sar, recordName)
+		}
+	}
+}
+
+// statRecordDate returns the date of the module download record targeted by
+// the recordName.
+func statRecordDate(recordName string) string {
+	date, _, _ := strings.Cut(
+		strings.TrimPrefix(recordName, statRecordsPrefix),
+		"/",
+	)
+	return date
+}
+
+// moduleHostModuleVersionCount is the module version count of a module host.
+type moduleHostModuleVersionCount struct {
+	ModuleHost         string `json:"module_host"`
+	ModuleVersionCount int    `json:"module_version_count"`
+}
+
+func init() {
+	onStart(startStatJobs)
+}
+
+// startStatJobs starts the jobs that flush the module downloads and, if
+// enabled, aggregate them into the stats.
+func startStatJobs() {
+	if _, err := base.Cron.AddJob(
+		"* * * * *", // Every minute
+		cron.NewChain(
+			cron.SkipIfStillRunning(cron.DiscardLogger),
+		).Then(cron.FuncJob(func() {
+			err := flushModuleDownloads(base.Context)
+			if err == nil {
+				return
+			}
+
+			base.Logger.Error().Err(err).
+				Msg("failed to flush module downloads")
+		})),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add module download flush cron job")
+	}
+
+	base.Air.AddShutdownJob(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			time.Minute,
+		)
+		defer cancel()
+
+		if err := flushModuleDownloads(ctx); err != nil {
+			base.Logger.Error().Err(err).
+				Msg("failed to flush module downloads")
+		}
+	})
+
+	if !statsAggregationEnabled {
+		return
+	}
+
+	if _, err := base.Cron.AddJob(
+		"30 * * * *", // Every hour
+		cron.NewChain(
+			cron.SkipIfStillRunning(cron.DiscardLogger),
+		).Then(cron.FuncJob(func() {
+			err := aggregateStats(base.Context)
+			if err == nil {
+				return
+			}
+
+			base.Logger.Error().Err(err).
+				Msg("failed to aggregate stats")
+		})),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add stats aggregation cron job")
+	}
+}
+
+// recordModuleDownload records a module download for the Goproxy cache name.
+func recordModuleDownload(name string) {
+	modulePath, moduleVersion, _, ok := parseGoproxyCacheName(
+		strings.TrimPrefix(path.Clean(name), "/"),
+	)
+	if !ok || isPrivateModule(modulePath) {
+		return
+	}
+
+	md := moduleDownload{
+		Date:          time.Now().UTC().Format(time.DateOnly),
+		ModulePath:    modulePath,
+		ModuleVersion: moduleVersion,
+	}
+
+	moduleDownloadsMutex.Lock()
+	moduleDownloads[md]++
+	moduleDownloadsMutex.Unlock()
+}
+
+// flushModuleDownloads flushes the `moduleDownloads` into the module download
+// records. Downloads that failed to be flushed are kept for the next flush.
+func flushModuleDownloads(ctx context.Context) error {
+	moduleDownloadsMutex.Lock()
+	mds := moduleDownloads
+	moduleDownloads = map[moduleDownload]int{}
+	moduleDownloadsMutex.Unlock()
+
+	records := map[string][]moduleDownloadRecord{}
+	for md, downloadCount := range mds {
+		records[md.Date] = append(
+			records[md.Date],
+			moduleDownloadRecord{
+				ModulePath:    md.ModulePath,
+				ModuleVersion: md.ModuleVersion,
+				DownloadCount: downloadCount,
+			},
+		)
+	}
+
+	var errs []error
+	for date, dateRecords := range records {
+		id := make([]byte, 8)
+		rand.Read(id)
+
+		if err := putJSONObject(ctx, fmt.Sprint(
+			statRecordsPrefix,
+			date,
+			"/",
+			time.Now().UnixNano(),
+			"-",
+			hex.EncodeToString(id),
+		), dateRecords); err != nil {
+			moduleDownloadsMutex.Lock()
+			for _, r := range dateRecords {
+				moduleDownloads[moduleDownload{
+					Date:          date,
+					ModulePath:    r.ModulePath,
+					ModuleVersion: r.ModuleVersion,
+				}] += r.DownloadCount
+			}
+			moduleDownloadsMutex.Unlock()
+
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// aggregateStats aggregates the module download records of all complete days
+// into the stat objects, and then updates the stat trends and summary.
+//
+// A failed aggregation will be retried in full. As each stat object keeps the
+// names of the module download records applied to it, no download is counted
+// more than once.
+func aggregateStats(ctx context.Context) error {
+	today := time.Now().UTC().Format(time.DateOnly)
+
+	recordNames := map[string][]string{}
+	for object, err := range objectStorage.List(
+		ctx,
+		statRecordsPrefix,
+		"",
+	) {
+		if err != nil {
+			return err
+		}
+
+		if date := statRecordDate(object.Name); date < today {
+			recordNames[date] = append(
+				recordNames[date],
+				object.Name,
+			)
+		}
+	}
+
+	dates := slices.Sorted(maps.Keys(recordNames))
+	for _, date := range dates {
+		if err := aggregateDailyStats(
+			ctx,
+			date,
+			recordNames[date],
+		); err != nil {
+			return err
+		}
+	}
+
+	if len(dates) > 0 {
+		if err := updateStatTrends(ctx); err != nil {
+			return err
+		}
+	} else if _, err := objectStorage.Stat(
+		ctx,
+		"stats/summary",
+	); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return updateStatSummary(ctx)
+}
+
+// aggregateDailyStats aggregates the module download records targeted by the
+// recordNames of the date into the stat objects.
+func aggregateDailyStats(
+	ctx context.Context,
+	date string,
+	recordNames []string,
+) error {
+	d, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return err
+	}
+
+	// The downloads are keyed by the module path, the module version and
+	// the record name.
+	downloads := map[string]map[string]map[string]int{}
+	for _, recordName := range recordNames {
+		var records []moduleDownloadRecord
+		if err := getJSONObject(ctx, recordName, &records); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		for _, r := range records {
+			if isPrivateModule(r.ModulePath) {
+				continue
+			}
+
+			versions := downloads[r.ModulePath]
+			if versions == nil {
+				versions = map[string]map[string]int{}
+				downloads[r.ModulePath] = versions
+			}
+
+			recordCounts := versions[r.ModuleVersion]
+			if recordCounts == nil {
+				recordCounts = map[string]int{}
+				versions[r.ModuleVersion] = recordCounts
+			}
+
+			recordCounts[recordName] += r.DownloadCount
+		}
+	}
+
+	dailyName := fmt.Sprint(statDailiesPrefix, date)
+	daily := statDaily{DownloadCounts: map[string]int{}}
+	if err := getJSONObject(
+		ctx,
+		dailyName,
+		&daily,
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	dailyAppliedRecords := daily.AppliedRecords.set()
+	for modulePath, versions := range downloads {
+		var moduleStat moduleVersionStat
+		if err := getJSONObject(
+			ctx,
+			path.Join("stats", modulePath),
+			&moduleStat,
+		); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		moduleRecordCounts := map[string]int{}
+		for moduleVersion, recordCounts := range versions {
+			name := path.Join(
+				"stats",
+				fmt.Sprint(modulePath, "@", moduleVersion),
+			)
+
+			var stat moduleVersionStat
+			if err := getJSONObject(
+				ctx,
+				name,
+				&stat,
+			); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+
+			appliedRecords := stat.AppliedRecords.set()
+			for recordName, downloadCount := range recordCounts {
+				moduleRecordCounts[recordName] += downloadCount
+				if !appliedRecords[recordName] {
+					stat.addDownloadCount(d, downloadCount)
+				}
+
+				if !dailyAppliedRecords[recordName] {
+					daily.DownloadCounts[modulePath] +=
+						downloadCount
+				}
+			}
+
+			stat.AppliedRecords.add(
+				date,
+				slices.Collect(maps.Keys(recordCounts))...,
+			)
+			if err := putJSONObject(ctx, name, stat); err != nil {
+				return err
+			}
+
+			moduleStat.updateTop10ModuleVersions(
+				moduleVersion,
+				stat.DownloadCount,
+			)
+		}
+
+		appliedRecords := moduleStat.AppliedRecords.set()
+		for recordName, downloadCount := range moduleRecordCounts {
+			if !appliedRecords[recordName] {
+				moduleStat.addDownloadCount(d, downloadCount)
+			}
+		}
+
+		moduleStat.AppliedRecords.add(
+			date,
+			slices.Collect(maps.Keys(moduleRecordCounts))...,
+		)
+		if err := putJSONObject(
+			ctx,
+			path.Join("stats", modulePath),
+			moduleStat,
+		); err != nil {
+			return err
+		}
+
+		badge, err := downloadCountBadge(moduleStat.DownloadCount)
+		if err != nil {
+			return err
+		}
+
+		if err := objectStorage.Put(
+			ctx,
+			path.Join("stats", modulePath)+downloadCountBadgeSuffix,
+			bytes.NewReader(badge),
+		); err != nil {
+			return err
+		}
+	}
+
+	daily.AppliedRecords.add(date, recordNames...)
+	if err := putJSONObject(ctx, dailyName, daily); err != nil {
+		return err
+	}
+
+	for _, recordName := range recordNames {
+		if err := objectStorage.Remove(ctx, recordName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateStatTrends updates the stat trends based on the daily module download
+// counts of the last 30 days. Older daily module download counts are removed.
+func updateStatTrends(ctx context.Context) error {
+	var dates []string
+	for object, err := range objectStorage.List(
+		ctx,
+		statDailiesPrefix,
+		"",
+	) {
+		if err != nil {
+			return err
+		}
+
+		dates = append(
+			dates,
+			strings.TrimPrefix(object.Name, statDailiesPrefix),
+		)
+	}
+
+	if len(dates) == 0 {
+		return nil
+	}
+
+	slices.Sort(dates)
+
+	latest, err := time.Parse(time.DateOnly, dates[len(dates)-1])
+	if err != nil {
+		return err
+	}
+
+	var (
+		latestTrend     = map[string]int{}
+		last7DaysTrend  = map[string]int{}
+		last30DaysTrend = map[string]int{}
+	)
+	for _, date := range dates {
+		d, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			continue
+		}
+
+		dailyName := fmt.Sprint(statDailiesPrefix, date)
+		if d.Before(latest.AddDate(0, 0, -29)) {
+			if err := objectStorage.Remove(
+				ctx,
+				dailyName,
+			); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		var daily statDaily
+		if err := getJSONObject(ctx, dailyName, &daily); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		isLatest := d.Equal(latest)
+		isLast7Days := !d.Before(latest.AddDate(0, 0, -6))
+		for modulePath, downloadCount := range daily.DownloadCounts {
+			if isPrivateModule(modulePath) {
+				continue
+			}
+
+			if isLatest {
+				latestTrend[modulePath] += downloadCount
+			}
+
+			if isLast7Days {
+				last7DaysTrend[modulePath] += downloadCount
+			}
+
+			last30DaysTrend[modulePath] += downloadCount
+		}
+	}
+
+	for trend, downloads := range map[string]map[string]int{
+		"latest":       latestTrend,
+		"last-7-days":  last7DaysTrend,
+		"last-30-days": last30DaysTrend,
+	} {
+		mdcs := make([]moduleDownloadCount, 0, len(downloads))
+		for modulePath, downloadCount := range downloads {
+			mdcs = append(mdcs, moduleDownloadCount{
+				ModulePath:    modulePath,
+				DownloadCount: downloadCount,
+			})
+		}
+
+		slices.SortFunc(mdcs, func(a, b moduleDownloadCount) int {
+			return cmp.Or(
+				cmp.Compare(b.DownloadCount, a.DownloadCount),
+				cmp.Compare(a.ModulePath, b.ModulePath),
+			)
+		})
+
+		if err := putJSONObject(
+			ctx,
+			fmt.Sprint("stats/trends/", trend),
+			mdcs[:min(len(mdcs), 1000)],
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateStatSummary updates the stat summary by walking through all public
+// module files in the `objectStorage`.
+func updateStatSummary(ctx context.Context) error {
+	var summary statSummary
+
+	moduleHosts := map[string]int{}
+	for object, err := range objectStorage.List(ctx, "", "") {
+		if err != nil {
+			return err
+		}
+
+		if isInternalStorageObject(object.Name) ||
+			strings.HasPrefix(object.Name, "sumdb/") {
+			continue
+		}
+
+		modulePath, _, nameExt, ok := parseGoproxyCacheName(object.Name)
+		if ok && isPrivateModule(modulePath) {
+			continue
+		}
+
+		summary.CacherSize += object.Size
+
+		if !ok || nameExt != ".zip" {
+			continue
+		}
+
+		summary.ModuleVersionCount++
+
+		moduleHost, _, _ := strings.Cut(modulePath, "/")
+		moduleHosts[moduleHost]++
+	}
+
+	summary.ModuleHostCount = len(moduleHosts)
+	for moduleHost, moduleVersionCount := range moduleHosts {
+		summary.Top10ModuleHosts = append(
+			summary.Top10ModuleHosts,
+			moduleHostModuleVersionCount{
+				ModuleHost:         moduleHost,
+				ModuleVersionCount: moduleVersionCount,
+			},
+		)
+	}
+
+	slices.SortFunc(summary.Top10ModuleHosts, func(
+		a moduleHostModuleVersionCount,
+		b moduleHostModuleVersionCount,
+	) int {
+		return cmp.Or(
+			cmp.Compare(b.ModuleVersionCount, a.ModuleVersionCount),
+			cmp.Compare(a.ModuleHost, b.ModuleHost),
+		)
+	})
+
+	summary.Top10ModuleHosts = summary.Top10ModuleHosts[:min(
+		len(summary.Top10ModuleHosts),
+		10,
+	)]
+
+	return putJSONObject(ctx, "stats/summary", summary)
+}
+
+// addDownloadCount adds the downloadCount of the date to the mvs.
+func (mvs *moduleVersionStat) addDownloadCount(
+	date time.Time,
+	downloadCount int,
+) {
+	mvs.DownloadCount += downloadCount
+
+	latest := date
+	for _, d := range mvs.Last30Days {
+		if d.Date.After(latest) {
+			latest = d.Date
+		}
+	}
+
+	mvs.updateLast30Days(latest)
+	for i := range mvs.Last30Days {
+		if mvs.Last30Days[i].Date.Equal(date) {
+			mvs.Last30Days[i].DownloadCount += downloadCount
+			break
+		}
+	}
+}
+
+// updateTop10ModuleVersions updates `mvs.Top10ModuleVersions` with the
+// downloadCount of the moduleVersion.
+func (mvs *moduleVersionStat) updateTop10ModuleVersions(
+	moduleVersion string,
+	downloadCount int,
+) {
+	mvs.Top10ModuleVersions = slices.DeleteFunc(
+		mvs.Top10ModuleVersions,
+		func(mvdc moduleVersionDownloadCount) bool {
+			return mvdc.ModuleVersion == moduleVersion
+		},
+	)
+
+	mvs.Top10ModuleVersions = append(
+		mvs.Top10ModuleVersions,
+		moduleVersionDownloadCount{
+			ModuleVersion: moduleVersion,
+			DownloadCount: downloadCount,
+		},
+	)
+
+	slices.SortFunc(mvs.Top10ModuleVersions, func(
+		a moduleVersionDownloadCount,
+		b moduleVersionDownloadCount,
+	) int {
+		return cmp.Or(
+			cmp.Compare(b.DownloadCount, a.DownloadCount),
+			cmp.Compare(a.ModuleVersion, b.ModuleVersion),
+		)
+	})
+
+	mvs.Top10ModuleVersions = mvs.Top10ModuleVersions[:min(
+		len(mvs.Top10ModuleVersions),
+		10,
+	)]
+}
+
+// downloadCountBadge returns a download count badge for the downloadCount. It
+// is generated by filling the downloadCount into the "unknown-badge.svg".
+func downloadCountBadge(downloadCount int) ([]byte, error) {
+	unknownBadge, err := os.ReadFile("unknown-badge.svg")
+	if err != nil {
+		return nil, err
+	}
+
+	text := thousandsCommaSeperated(int64(downloadCount))
+	textLength := 70*len(text) - 35*strings.Count(text, ",")
+	width := 88 + textLength/10 + 10
+
+	return []byte(strings.NewReplacer(
+		`width="149"`, fmt.Sprintf(`width="%d"`, width),
+		"M88 0h61v20H88z", fmt.Sprintf("M88 0h%dv20H88z", width-88),
+		"M0 0h149v20H0z", fmt.Sprintf("M0 0h%dv20H0z", width),
+		`x="1175"`, fmt.Sprintf(`x="%d"`, 880+(width-88)*5),
+		`textLength="510">unknown<`, fmt.Sprintf(
+			`textLength="%d">%s<`,
+			textLength,
+			text,
+		),
+	).Replace(string(unknownBadge))), nil
+}
@@ -0,0 +1,384 @@
+package handler
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/mod/module"
+)
+
+// authSubjectKey is the key of the authenticated subject in the request
+// values.
+const authSubjectKey = "auth_subject"
+
+var (
+	// authEnabled indicates whether the authentication is enabled.
+	authEnabled = base.Viper.GetBool("auth.enabled")
+
+	// authAPITokens is the API tokens used to authenticate requests.
+	authAPITokens []authAPIToken
+
+	// authHtpasswd is the username-hash pairs loaded from the htpasswd
+	// file.
+	authHtpasswd map[string]string
+
+	// authJWTVerifier is used to verify the OIDC bearer tokens. It is nil
+	// if no OIDC issuer is configured.
+	authJWTVerifier *jwtVerifier
+
+	// authPolicies is the access policies of the module path prefixes.
+	authPolicies []authPolicy
+
+	// errAuthInvalidCredentials is the error of invalid credentials.
+	errAuthInvalidCredentials = errors.New("invalid credentials")
+
+	// errAuthNonCanonicalPath is the error of a non-canonical request
+	// path (e.g. "/a//b" or "/a/./b").
+	errAuthNonCanonicalPath = errors.New("non-canonical path")
+
+	// errAuthInvalidModulePath is the error of a request path that looks
+	// like it targets a module but fails to parse.
+	errAuthInvalidModulePath = errors.New("invalid module path")
+)
+
+// authAPIToken is an API token.
+type authAPIToken struct {
+	Subject string `mapstructure:"subject"`
+	Token   string `mapstructure:"token"`
+}
+
+// authPolicy is the access policy of a module path prefix.
+type authPolicy struct {
+	// Prefix is the module path prefix the policy applies to. It matches
+	// on path element boundaries, and the longest matching prefix wins.
+	// An empty prefix matches all module paths as well as the requests
+	// that do not target any module (e.g. "/stats/summary").
+	Prefix string `mapstructure:"prefix"`
+
+	// Anonymous indicates whether anonymous requests are allowed.
+	Anonymous bool `mapstructure:"anonymous"`
+
+	// Subjects is the subjects allowed. An empty list allows any
+	// authenticated subject.
+	Subjects []string `mapstructure:"subjects"`
+}
+
+func init() {
+	if !authEnabled {
+		return
+	}
+
+	if err := base.Viper.UnmarshalKey(
+		"auth.api_tokens",
+		&authAPITokens,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal auth api tokens")
+	}
+
+	if err := base.Viper.UnmarshalKey(
+		"auth.policies",
+		&authPolicies,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal auth policies")
+	}
+
+	if htpasswdFile := base.Viper.GetString(
+		"auth.htpasswd_file",
+	); htpasswdFile != "" {
+		var err error
+		if authHtpasswd, err = loadAuthHtpasswd(
+			htpasswdFile,
+		); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to load auth htpasswd file")
+		}
+	}
+
+	if oidcIssuer := base.Viper.GetString(
+		"auth.oidc_issuer",
+	); oidcIssuer != "" {
+		authJWTVerifier = newJWTVerifier(
+			oidcIssuer,
+			base.Viper.GetString("auth.oidc_audience"),
+			base.Viper.GetString("auth.oidc_jwks_url"),
+			base.Viper.GetString("auth.oidc_subject_claim"),
+		)
+	}
+}
+
+// authGas is used to authenticate requests and authorize them based on the
+// `authPolicies`. It does nothing if the `authEnabled` is false.
+func authGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !authEnabled {
+			return next(req, res)
+		}
+
+		// Any path that fails to parse is denied, as falling back to
+		// the policy of the requests that do not target any module
+		// may let it bypass the policy of its module.
+		modulePath, err := authModulePath(req)
+		if errors.Is(err, errAuthNonCanonicalPath) {
+			return NotFound(req, res)
+		} else if err != nil {
+			return Forbidden(req, res)
+		}
+
+		subject, err := authenticate(req)
+		if err != nil {
+			return Unauthorized(req, res)
+		}
+
+		if subject != "" {
+			req.SetValue(authSubjectKey, subject)
+		}
+
+		policy := matchAuthPolicy(modulePath)
+		if policy.Anonymous {
+			return next(req, res)
+		}
+
+		// Restricted responses must not be shared across credentials
+		// by caches.
+		res.Header.Add("Vary", "Authorization")
+
+		if subject == "" {
+			return Unauthorized(req, res)
+		} else if len(policy.Subjects) > 0 &&
+			!slices.Contains(policy.Subjects, subject) {
+			return Forbidden(req, res)
+		}
+
+		return next(req, res)
+	}
+}
+
+// Unauthorized returns unauthorized error.
+func Unauthorized(req *air.Request, res *air.Response) error {
+	res.Status = http.StatusUnauthorized
+	res.Header.Set(
+		"WWW-Authenticate",
+		`Basic realm="`+req.Air.AppName+`"`,
+	)
+	return errors.New(strings.ToLower(http.StatusText(res.Status)))
+}
+
+// Forbidden returns forbidden error.
+func Forbidden(req *air.Request, res *air.Response) error {
+	res.Status = http.StatusForbidden
+	return errors.New(strings.ToLower(http.StatusText(res.Status)))
+}
+
+// authenticate returns the subject authenticated by the credentials carried
+// in the req. It returns "" if the req carries no credentials.
+func authenticate(req *air.Request) (string, error) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return "", nil
+	}
+
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	credentials = strings.TrimSpace(credentials)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		username, password, ok := req.HTTPRequest().BasicAuth()
+		if !ok {
+			break
+		}
+
+		if hash, ok := authHtpasswd[username]; ok &&
+			verifyAuthHtpasswdHash(hash, password) {
+			return username, nil
+		}
+
+		// Go clients (e.g. via netrc) can only send API tokens as
+		// passwords.
+		if subject, ok := authAPITokenSubject(password); ok {
+			return subject, nil
+		}
+	case "bearer":
+		if subject, ok := authAPITokenSubject(credentials); ok {
+			return subject, nil
+		}
+
+		if authJWTVerifier != nil {
+			subject, err := authJWTVerifier.verify(
+				req.Context,
+				credentials,
+			)
+			if err == nil {
+				return subject, nil
+			}
+
+			base.Logger.Debug().Err(err).
+				Msg("failed to verify auth bearer token")
+		}
+	}
+
+	return "", errAuthInvalidCredentials
+}
+
+// authAPITokenSubject returns the subject of the token in the `authAPITokens`.
+func authAPITokenSubject(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+
+	var (
+		subject string
+		found   bool
+	)
+
+	for _, aat := range authAPITokens {
+		if subtle.ConstantTimeCompare(
+			[]byte(aat.Token),
+			[]byte(token),
+		) == 1 {
+			subject, found = aat.Subject, true
+		}
+	}
+
+	return subject, found
+}
+
+// matchAuthPolicy returns the policy in the `authPolicies` with the longest
+// prefix matching the modulePath. The zero value of the `authPolicy` is
+// returned if no policy matches.
+func matchAuthPolicy(modulePath string) authPolicy {
+	var (
+		matched    authPolicy
+		matchedLen = -1
+	)
+
+	for _, ap := range authPolicies {
+		if ap.Prefix != "" &&
+			modulePath != ap.Prefix &&
+			!strings.HasPrefix(modulePath, ap.Prefix+"/") {
+			continue
+		}
+
+		if len(ap.Prefix) > matchedLen {
+			matched, matchedLen = ap, len(ap.Prefix)
+		}
+	}
+
+	return matched
+}
+
+// authModulePath returns the module path targeted by the req. It returns "" if
+// the req does not target any module.
+//
+// The `errAuthNonCanonicalPath` is returned if the path of the req is not
+// canonical, and the `errAuthInvalidModulePath` is returned if the path of the
+// req targets a module but fails to parse.
+func authModulePath(req *air.Request) (string, error) {
+	name, err := url.PathUnescape(req.RawPath())
+	if err != nil {
+		return "", errAuthNonCanonicalPath
+	} else if path.Clean(name) != name {
+		return "", errAuthNonCanonicalPath
+	}
+
+	name = strings.TrimPrefix(name, "/")
+	if strings.HasPrefix(name, "sumdb/") {
+		return "", nil
+	}
+
+	if statName, ok := strings.CutPrefix(name, "stats/"); ok {
+		if statName == "summary" ||
+			strings.HasPrefix(statName, "trends/") {
+			return "", nil
+		}
+
+		statName = strings.TrimSuffix(
+			statName,
+			downloadCountBadgeSuffix,
+		)
+
+		modulePath, _, _ := strings.Cut(statName, "@")
+		if module.CheckPath(modulePath) != nil {
+			return "", errAuthInvalidModulePath
+		}
+
+		return modulePath, nil
+	}
+
+	escapedModulePath, _, found := strings.Cut(name, "/@")
+	if !found {
+		return "", nil
+	}
+
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return "", errAuthInvalidModulePath
+	}
+
+	return modulePath, nil
+}
+
+// loadAuthHtpasswd loads the username-hash pairs from the htpasswd file
+// targeted by the name.
+func loadAuthHtpasswd(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	htpasswd := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		if !strings.HasPrefix(hash, "$2") &&
+			!strings.HasPrefix(hash, "{SHA}") {
+			base.Logger.Warn().Str("username", username).
+				Msg("unsupported auth htpasswd hash, only " +
+					"bcrypt and sha1 are supported")
+			continue
+		}
+
+		htpasswd[username] = hash
+	}
+
+	return htpasswd, s.Err()
+}
+
+// verifyAuthHtpasswdHash reports whether the password matches the htpasswd
+// hash.
+func verifyAuthHtpasswdHash(hash, password string) bool {
+	if sha1Hash, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare(
+			[]byte(sha1Hash),
+			[]byte(base64.StdEncoding.EncodeToString(sum[:])),
+		) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword(
+		[]byte(hash),
+		[]byte(password),
+	) == nil
+}
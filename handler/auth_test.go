@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aofei/air"
+)
+
+func TestAuthModulePath(t *testing.T) {
+	for _, tt := range []struct {
+		path           string
+		wantModulePath string
+		wantErr        error
+	}{
+		{
+			path:           "/example.com/a/@v/list",
+			wantModulePath: "example.com/a",
+		},
+		{
+			path:           "/example.com/!a/@v/v1.0.0.zip",
+			wantModulePath: "example.com/A",
+		},
+		{
+			path:           "/example.com/a/@v/list?foo=bar",
+			wantModulePath: "example.com/a",
+		},
+		{
+			path:           "/stats/example.com/a@v1.0.0",
+			wantModulePath: "example.com/a",
+		},
+		{
+			path:           "/stats/example.com/a?foo=bar",
+			wantModulePath: "example.com/a",
+		},
+		{
+			path: "/stats/example.com/a" +
+				downloadCountBadgeSuffix,
+			wantModulePath: "example.com/a",
+		},
+		{path: "/stats/summary"},
+		{path: "/stats/trends/latest"},
+		{path: "/sumdb/sum.golang.org/supported"},
+		{path: "/metrics"},
+		{path: "/"},
+		{
+			path:    "/example.com//a/@v/list",
+			wantErr: errAuthNonCanonicalPath,
+		},
+		{
+			path:    "/example.com/./a/@v/list",
+			wantErr: errAuthNonCanonicalPath,
+		},
+		{
+			path:    "/example.com/%2E/a/@v/list",
+			wantErr: errAuthNonCanonicalPath,
+		},
+		{
+			path:    "/stats/example.com/../b",
+			wantErr: errAuthNonCanonicalPath,
+		},
+		{
+			path:    "/example.com/a/@v/%zz",
+			wantErr: errAuthNonCanonicalPath,
+		},
+		{
+			path:    "/example.com/A/@v/list",
+			wantErr: errAuthInvalidModulePath,
+		},
+		{
+			path:    "/stats/not-a-module",
+			wantErr: errAuthInvalidModulePath,
+		},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			modulePath, err := authModulePath(&air.Request{
+				Path: tt.path,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf(
+					"got error %v, want %v",
+					err,
+					tt.wantErr,
+				)
+			}
+
+			if modulePath != tt.wantModulePath {
+				t.Errorf(
+					"got module path %q, want %q",
+					modulePath,
+					tt.wantModulePath,
+				)
+			}
+		})
+	}
+}
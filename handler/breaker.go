@@ -0,0 +1,404 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+// errStorageCircuitOpen is returned by the `objectStorage` operations that are
+// rejected by the `objectStorageBreaker`.
+var errStorageCircuitOpen = errors.New("storage circuit breaker is open")
+
+// objectStorageBreaker is the circuit breaker of the `objectStorage`. It is nil
+// if disabled.
+var objectStorageBreaker *storageBreaker
+
+// storageBreakerState is the state of a `storageBreaker`.
+type storageBreakerState int
+
+// The states of a `storageBreaker`.
+const (
+	storageBreakerClosed storageBreakerState = iota
+	storageBreakerHalfOpen
+	storageBreakerOpen
+)
+
+// String implements the `fmt.Stringer`.
+func (sbs storageBreakerState) String() string {
+	switch sbs {
+	case storageBreakerClosed:
+		return "closed"
+	case storageBreakerHalfOpen:
+		return "half-open"
+	case storageBreakerOpen:
+		return "open"
+	}
+
+	return "unknown"
+}
+
+// storageBreakerResult is the result of an operation reported to a
+// `storageBreaker`.
+type storageBreakerResult int
+
+// The results of the operations reported to a `storageBreaker`.
+const (
+	storageBreakerSucceeded storageBreakerResult = iota
+	storageBreakerFailed
+	storageBreakerIgnored
+)
+
+// storageBreaker is a circuit breaker of the `storage` operations.
+//
+// It is closed at first, and opens once the ratio of the failed operations in
+// a window reaches the failure ratio. While open, all operations are rejected
+// until the open timeout elapses. Then it becomes half-open and lets a limited
+// number of trial operations through, which close it if they all succeed, or
+// open it again at the first failure. Ignored results (e.g. of operations
+// canceled by their callers) count neither way, but still free their trials.
+type storageBreaker struct {
+	failureRatio        float64
+	minRequests         int
+	window              time.Duration
+	openTimeout         time.Duration
+	halfOpenMaxRequests int
+
+	mutex              sync.Mutex
+	state              storageBreakerState
+	generation         uint64
+	changedAt          time.Time
+	requests           int
+	failures           int
+	halfOpenSuccesses  int
+	halfOpenInProgress int
+}
+
+// newStorageBreaker returns a new instance of the `storageBreaker` based on the
+// configuration items in the v.
+func newStorageBreaker(v *viper.Viper) *storageBreaker {
+	sb := &storageBreaker{
+		failureRatio:        v.GetFloat64("failure_ratio"),
+		minRequests:         v.GetInt("min_requests"),
+		window:              v.GetDuration("window"),
+		openTimeout:         v.GetDuration("open_timeout"),
+		halfOpenMaxRequests: v.GetInt("half_open_max_requests"),
+	}
+	if sb.failureRatio <= 0 || sb.failureRatio > 1 {
+		sb.failureRatio = 0.5
+	}
+
+	if sb.minRequests <= 0 {
+		sb.minRequests = 20
+	}
+
+	if sb.window <= 0 {
+		sb.window = time.Minute
+	}
+
+	if sb.openTimeout <= 0 {
+		sb.openTimeout = 30 * time.Second
+	}
+
+	if sb.halfOpenMaxRequests <= 0 {
+		sb.halfOpenMaxRequests = 5
+	}
+
+	sb.setState(storageBreakerClosed, time.Now())
+
+	return sb
+}
+
+// State returns the current state of the sb.
+func (sb *storageBreaker) State() storageBreakerState {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.advance(time.Now())
+	return sb.state
+}
+
+// allow reports whether an operation is allowed by the sb. If so, its result
+// must be reported with the returned generation.
+func (sb *storageBreaker) allow() (uint64, bool) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	sb.advance(time.Now())
+	switch sb.state {
+	case storageBreakerOpen:
+		return 0, false
+	case storageBreakerHalfOpen:
+		if sb.halfOpenInProgress >= sb.halfOpenMaxRequests {
+			return 0, false
+		}
+
+		sb.halfOpenInProgress++
+	}
+
+	return sb.generation, true
+}
+
+// report reports the result of an operation allowed by the sb in the
+// generation. Results of the past generations are ignored.
+func (sb *storageBreaker) report(
+	generation uint64,
+	result storageBreakerResult,
+) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	now := time.Now()
+	sb.advance(now)
+	if generation != sb.generation {
+		return
+	}
+
+	switch sb.state {
+	case storageBreakerClosed:
+		if result == storageBreakerIgnored {
+			return
+		}
+
+		sb.requests++
+		if result == storageBreakerFailed {
+			sb.failures++
+		}
+
+		if sb.requests >= sb.minRequests &&
+			float64(sb.failures) >=
+				sb.failureRatio*float64(sb.requests) {
+			sb.setState(storageBreakerOpen, now)
+		}
+	case storageBreakerHalfOpen:
+		sb.halfOpenInProgress--
+		switch result {
+		case storageBreakerIgnored:
+			return
+		case storageBreakerFailed:
+			sb.setState(storageBreakerOpen, now)
+			return
+		}
+
+		sb.halfOpenSuccesses++
+		if sb.halfOpenSuccesses >= sb.halfOpenMaxRequests {
+			sb.setState(storageBreakerClosed, now)
+		}
+	}
+}
+
+// advance advances the sb to the now. It starts a new window if the current
+// one has ended, or becomes half-open if the open timeout has elapsed.
+func (sb *storageBreaker) advance(now time.Time) {
+	switch sb.state {
+	case storageBreakerClosed:
+		if now.Sub(sb.changedAt) >= sb.window {
+			sb.generation++
+			sb.changedAt = now
+			sb.requests = 0
+			sb.failures = 0
+		}
+	case storageBreakerOpen:
+		if now.Sub(sb.changedAt) >= sb.openTimeout {
+			sb.setState(storageBreakerHalfOpen, now)
+		}
+	}
+}
+
+// setState sets the state of the sb to the state at the now.
+func (sb *storageBreaker) setState(state storageBreakerState, now time.Time) {
+	if state != sb.state {
+		storageBreakerTransitionsTotal.WithLabelValues(
+			state.String(),
+		).Inc()
+
+		event := base.Logger.Info()
+		if state == storageBreakerOpen {
+			event = base.Logger.Warn()
+		}
+
+		if sb.state == storageBreakerClosed {
+			event = event.Int("requests", sb.requests).
+				Int("failures", sb.failures)
+		}
+
+		event.Str("from", sb.state.String()).
+			Str("to", state.String()).
+			Msg("storage circuit breaker changed state")
+	}
+
+	sb.state = state
+	sb.generation++
+	sb.changedAt = now
+	sb.requests = 0
+	sb.failures = 0
+	sb.halfOpenSuccesses = 0
+	sb.halfOpenInProgress = 0
+
+	for _, s := range []storageBreakerState{
+		storageBreakerClosed,
+		storageBreakerHalfOpen,
+		storageBreakerOpen,
+	} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+
+		storageBreakerStateGauge.WithLabelValues(s.String()).Set(value)
+	}
+}
+
+// do does the f through the sb. Its result is the `storageBreakerResultOf` the
+// ctx and the error it returns.
+func (sb *storageBreaker) do(ctx context.Context, f func() error) error {
+	generation, ok := sb.allow()
+	if !ok {
+		storageBreakerRejectionsTotal.Inc()
+		return errStorageCircuitOpen
+	}
+
+	err := f()
+	sb.report(generation, storageBreakerResultOf(ctx, err))
+
+	return err
+}
+
+// storageBreakerResultOf returns the result of an operation with the ctx that
+// returned the err. The err is a failure of the `storage` unless it is the
+// `fs.ErrNotExist`, and it is ignored if the ctx has been canceled or its
+// deadline has been exceeded, as the caller gave up rather than the `storage`.
+func storageBreakerResultOf(
+	ctx context.Context,
+	err error,
+) storageBreakerResult {
+	switch {
+	case err == nil, errors.Is(err, fs.ErrNotExist):
+		return storageBreakerSucceeded
+	case ctx.Err() != nil:
+		return storageBreakerIgnored
+	}
+
+	return storageBreakerFailed
+}
+
+// breakerStorage implements the `storage` by guarding an underlying one with a
+// `storageBreaker`. The `storage.Presign` is not guarded as it is done
+// locally.
+type breakerStorage struct {
+	storage
+
+	breaker *storageBreaker
+}
+
+// Get implements the `storage`.
+func (bs *breakerStorage) Get(ctx context.Context, name string) (
+	io.ReadSeekCloser,
+	storageObjectInfo,
+	error,
+) {
+	var (
+		content    io.ReadSeekCloser
+		objectInfo storageObjectInfo
+	)
+
+	err := bs.breaker.do(ctx, func() error {
+		var err error
+		content, objectInfo, err = bs.storage.Get(ctx, name)
+		return err
+	})
+
+	return content, objectInfo, err
+}
+
+// Stat implements the `storage`.
+func (bs *breakerStorage) Stat(
+	ctx context.Context,
+	name string,
+) (storageObjectInfo, error) {
+	var objectInfo storageObjectInfo
+	err := bs.breaker.do(ctx, func() error {
+		var err error
+		objectInfo, err = bs.storage.Stat(ctx, name)
+		return err
+	})
+
+	return objectInfo, err
+}
+
+// Put implements the `storage`.
+func (bs *breakerStorage) Put(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+) error {
+	return bs.breaker.do(ctx, func() error {
+		return bs.storage.Put(ctx, name, content)
+	})
+}
+
+// Remove implements the `storage`.
+func (bs *breakerStorage) Remove(ctx context.Context, name string) error {
+	return bs.breaker.do(ctx, func() error {
+		return bs.storage.Remove(ctx, name)
+	})
+}
+
+// List implements the `storage`. The whole listing counts as one operation.
+func (bs *breakerStorage) List(
+	ctx context.Context,
+	prefix string,
+	startAfter string,
+) iter.Seq2[storageObjectInfo, error] {
+	return func(yield func(storageObjectInfo, error) bool) {
+		generation, ok := bs.breaker.allow()
+		if !ok {
+			storageBreakerRejectionsTotal.Inc()
+			yield(storageObjectInfo{}, errStorageCircuitOpen)
+			return
+		}
+
+		var err error
+		defer func() {
+			bs.breaker.report(
+				generation,
+				storageBreakerResultOf(ctx, err),
+			)
+		}()
+
+		for objectInfo, listErr := range bs.storage.List(
+			ctx,
+			prefix,
+			startAfter,
+		) {
+			if listErr != nil {
+				err = listErr
+			}
+
+			if !yield(objectInfo, listErr) {
+				return
+			}
+		}
+	}
+}
+
+// AbortStaleUploads implements the `storage`.
+func (bs *breakerStorage) AbortStaleUploads(
+	ctx context.Context,
+	maxAge time.Duration,
+) (int, error) {
+	var n int
+	err := bs.breaker.do(ctx, func() error {
+		var err error
+		n, err = bs.storage.AbortStaleUploads(ctx, maxAge)
+		return err
+	})
+
+	return n, err
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// newTestStorageBreaker returns a new instance of the `storageBreaker` that
+// opens at the failure ratio 0.5 of 4 operations and lets 2 trials through.
+func newTestStorageBreaker() *storageBreaker {
+	v := viper.New()
+	v.Set("failure_ratio", 0.5)
+	v.Set("min_requests", 4)
+	v.Set("window", time.Hour)
+	v.Set("open_timeout", time.Hour)
+	v.Set("half_open_max_requests", 2)
+	return newStorageBreaker(v)
+}
+
+// elapse makes the d elapse for the sb.
+func (sb *storageBreaker) elapse(d time.Duration) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.changedAt = sb.changedAt.Add(-d)
+}
+
+// mustAllow is like the `allow`, but fails the t if it is not allowed.
+func (sb *storageBreaker) mustAllow(t *testing.T) uint64 {
+	t.Helper()
+	generation, ok := sb.allow()
+	if !ok {
+		t.Fatalf("not allowed in state %v", sb.State())
+	}
+
+	return generation
+}
+
+func TestStorageBreaker(t *testing.T) {
+	wantState := func(
+		t *testing.T,
+		sb *storageBreaker,
+		want storageBreakerState,
+	) {
+		t.Helper()
+		if got := sb.State(); got != want {
+			t.Fatalf("got state %v, want %v", got, want)
+		}
+	}
+
+	// open returns a new instance of the `storageBreaker` that has
+	// become half-open.
+	open := func(t *testing.T) *storageBreaker {
+		t.Helper()
+		sb := newTestStorageBreaker()
+		for _, result := range []storageBreakerResult{
+			storageBreakerSucceeded,
+			storageBreakerFailed,
+			storageBreakerSucceeded,
+			storageBreakerFailed,
+		} {
+			sb.report(sb.mustAllow(t), result)
+		}
+
+		wantState(t, sb, storageBreakerOpen)
+		if _, ok := sb.allow(); ok {
+			t.Fatal("allowed while open")
+		}
+
+		sb.elapse(sb.openTimeout)
+		wantState(t, sb, storageBreakerHalfOpen)
+
+		return sb
+	}
+
+	t.Run("Closed", func(t *testing.T) {
+		sb := newTestStorageBreaker()
+		for _, result := range []storageBreakerResult{
+			storageBreakerFailed,
+			storageBreakerIgnored,
+			storageBreakerIgnored,
+			storageBreakerIgnored,
+			storageBreakerSucceeded,
+			storageBreakerSucceeded,
+		} {
+			sb.report(sb.mustAllow(t), result)
+		}
+
+		wantState(t, sb, storageBreakerClosed)
+
+		sb.elapse(sb.window)
+		generation := sb.mustAllow(t)
+		for range 3 {
+			sb.report(sb.mustAllow(t), storageBreakerFailed)
+		}
+
+		wantState(t, sb, storageBreakerClosed)
+
+		sb.report(generation, storageBreakerFailed)
+		wantState(t, sb, storageBreakerOpen)
+	})
+
+	t.Run("StaleGeneration", func(t *testing.T) {
+		sb := newTestStorageBreaker()
+		generation := sb.mustAllow(t)
+		sb.elapse(sb.window)
+		for range 3 {
+			sb.report(sb.mustAllow(t), storageBreakerSucceeded)
+		}
+
+		sb.report(generation, storageBreakerFailed)
+		sb.report(sb.mustAllow(t), storageBreakerFailed)
+		wantState(t, sb, storageBreakerClosed)
+	})
+
+	t.Run("HalfOpenCloses", func(t *testing.T) {
+		sb := open(t)
+		first := sb.mustAllow(t)
+		second := sb.mustAllow(t)
+		if _, ok := sb.allow(); ok {
+			t.Fatal("allowed beyond the half-open max requests")
+		}
+
+		sb.report(first, storageBreakerSucceeded)
+		wantState(t, sb, storageBreakerHalfOpen)
+
+		sb.report(second, storageBreakerSucceeded)
+		wantState(t, sb, storageBreakerClosed)
+	})
+
+	t.Run("HalfOpenFreesTrials", func(t *testing.T) {
+		sb := open(t)
+		first := sb.mustAllow(t)
+		second := sb.mustAllow(t)
+		sb.report(first, storageBreakerIgnored)
+		sb.report(second, storageBreakerSucceeded)
+		wantState(t, sb, storageBreakerHalfOpen)
+
+		sb.report(sb.mustAllow(t), storageBreakerSucceeded)
+		wantState(t, sb, storageBreakerClosed)
+	})
+
+	t.Run("HalfOpenReopens", func(t *testing.T) {
+		sb := open(t)
+		first := sb.mustAllow(t)
+		second := sb.mustAllow(t)
+		sb.report(first, storageBreakerFailed)
+		wantState(t, sb, storageBreakerOpen)
+
+		sb.report(second, storageBreakerSucceeded)
+		wantState(t, sb, storageBreakerOpen)
+		if _, ok := sb.allow(); ok {
+			t.Fatal("allowed while open")
+		}
+	})
+}
+
+func TestStorageBreakerDo(t *testing.T) {
+	sb := newTestStorageBreaker()
+	errFailed := errors.New("failed")
+	for range 4 {
+		if err := sb.do(context.Background(), func() error {
+			return errFailed
+		}); !errors.Is(err, errFailed) {
+			t.Fatalf("got error %v, want %v", err, errFailed)
+		}
+	}
+
+	if err := sb.do(context.Background(), func() error {
+		t.Fatal("called while open")
+		return nil
+	}); !errors.Is(err, errStorageCircuitOpen) {
+		t.Fatalf("got error %v, want %v", err, errStorageCircuitOpen)
+	}
+}
+
+func TestStorageBreakerResultOf(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expiredCtx, cancel := context.WithDeadline(
+		context.Background(),
+		time.Now(),
+	)
+	defer cancel()
+
+	for _, tt := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want storageBreakerResult
+	}{
+		{
+			name: "Nil",
+			ctx:  context.Background(),
+			want: storageBreakerSucceeded,
+		},
+		{
+			name: "NotExist",
+			ctx:  context.Background(),
+			err:  fs.ErrNotExist,
+			want: storageBreakerSucceeded,
+		},
+		{
+			name: "Failed",
+			ctx:  context.Background(),
+			err:  errors.New("failed"),
+			want: storageBreakerFailed,
+		},
+		{
+			name: "StorageDeadlineExceeded",
+			ctx:  context.Background(),
+			err:  context.DeadlineExceeded,
+			want: storageBreakerFailed,
+		},
+		{
+			name: "CtxCanceled",
+			ctx:  canceledCtx,
+			err:  context.Canceled,
+			want: storageBreakerIgnored,
+		},
+		{
+			name: "CtxDeadlineExceeded",
+			ctx:  expiredCtx,
+			err:  context.DeadlineExceeded,
+			want: storageBreakerIgnored,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := storageBreakerResultOf(tt.ctx, tt.err)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
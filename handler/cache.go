@@ -0,0 +1,506 @@
+package handler
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// errInvalidCacheObject is the error of a cached module file whose content is
+// invalid.
+var errInvalidCacheObject = errors.New("invalid cache object")
+
+// errCacheObjectMissingChecksums is the error of a cached module file whose
+// content is valid but whose checksums are not stored, so that its corruption
+// in the `objectStorage` cannot be detected.
+var errCacheObjectMissingChecksums = errors.New(
+	"cache object missing checksums",
+)
+
+// ListCache writes the cached objects of the module to the w.
+func ListCache(ctx context.Context, w io.Writer, modulePath string) error {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return err
+	}
+
+	for object, err := range objectStorage.List(
+		ctx,
+		escapedModulePath+"/@",
+		"",
+	) {
+		if err != nil {
+			return err
+		}
+
+		if _, _, _, ok := parseGoproxyCacheName(
+			object.Name,
+		); !ok && !strings.HasSuffix(object.Name, "/@v/list") &&
+			!strings.HasSuffix(object.Name, "/@latest") {
+			continue
+		}
+
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%s\n",
+			object.Name,
+			object.Size,
+			object.LastModified.UTC().Format(time.RFC3339),
+		)
+	}
+
+	return nil
+}
+
+// StatCache writes the information of the cached object targeted by the name
+// to the w.
+func StatCache(ctx context.Context, w io.Writer, name string) error {
+	objectInfo, err := objectStorage.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "name: %s\n", objectInfo.Name)
+	fmt.Fprintf(w, "size: %d\n", objectInfo.Size)
+	fmt.Fprintf(w, "etag: %s\n", objectInfo.ETag)
+	fmt.Fprintf(w, "content_type: %s\n", objectInfo.ContentType)
+	if objectInfo.SHA256 != nil {
+		fmt.Fprintf(w, "sha256: %x\n", objectInfo.SHA256)
+	}
+
+	if objectInfo.MD5 != nil {
+		fmt.Fprintf(w, "md5: %x\n", objectInfo.MD5)
+	}
+
+	fmt.Fprintf(
+		w,
+		"last_modified: %s\n",
+		objectInfo.LastModified.UTC().Format(time.RFC3339),
+	)
+
+	return nil
+}
+
+// PurgeCache removes the cache of the module version (or all versions of the
+// module if the moduleVersion is empty) from the `objectStorage`.
+func PurgeCache(
+	ctx context.Context,
+	modulePath string,
+	moduleVersion string,
+) error {
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	if moduleVersion == "" {
+		for object, err := range objectStorage.List(
+			ctx,
+			escapedModulePath+"/@v/",
+			"",
+		) {
+			if err != nil {
+				return err
+			}
+
+			names = append(names, object.Name)
+		}
+
+		names = append(names, escapedModulePath+"/@latest")
+	} else {
+		escapedModuleVersion, err := module.EscapeVersion(moduleVersion)
+		if err != nil {
+			return err
+		}
+
+		for _, nameExt := range []string{".info", ".mod", ".zip"} {
+			names = append(names, fmt.Sprint(
+				escapedModulePath,
+				"/@v/",
+				escapedModuleVersion,
+				nameExt,
+			))
+		}
+
+		names = append(
+			names,
+			escapedModulePath+"/@v/list",
+			escapedModulePath+"/@latest",
+		)
+	}
+
+	for _, name := range names {
+		if err := objectStorage.Remove(ctx, name); err != nil {
+			return err
+		}
+
+		forgetCacheObject(name)
+	}
+
+	return nil
+}
+
+// forgetCacheObject forgets everything derived from the cached object targeted
+// by the name in this process, as the object has been removed.
+func forgetCacheObject(name string) {
+	if goproxyLocalCache != nil {
+		goproxyLocalCache.remove(name)
+	}
+
+	if redirectObjectInfos != nil {
+		redirectObjectInfos.Remove(name)
+	}
+
+	if redirectURLs != nil {
+		for _, method := range getHeadMethods {
+			redirectURLs.Remove(method + " " + name)
+		}
+	}
+}
+
+// goproxyResponseError returns the error of the grr.
+func goproxyResponseError(grr *goproxyResponseRecorder) error {
+	if body := strings.TrimSpace(grr.body.String()); body != "" {
+		return fmt.Errorf("%d %s", grr.status, body)
+	}
+
+	return fmt.Errorf("%d %s", grr.status, http.StatusText(grr.status))
+}
+
+// VerifyCache verifies all cached module files (or only those of the module if
+// the modulePath is not empty) and writes the invalid ones, those missing
+// checksums and those failed to be verified to the w. The failed ones (e.g. of
+// transient storage errors) may be verified again later.
+func VerifyCache(ctx context.Context, w io.Writer, modulePath string) error {
+	prefix, err := moduleVersionsCachePrefix(modulePath)
+	if err != nil {
+		return err
+	}
+
+	var checked, invalid, missingChecksums, failed int
+	for object, err := range objectStorage.List(ctx, prefix, "") {
+		if err != nil {
+			return err
+		}
+
+		if !validGoproxyCacheName(object.Name) {
+			continue
+		}
+
+		err := verifyCacheObject(ctx, object.Name)
+		switch {
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist):
+			continue // Removed since listed
+		case errors.Is(err, errCacheObjectMissingChecksums):
+			missingChecksums++
+			fmt.Fprintf(w, "%s: %v\n", object.Name, err)
+		case errors.Is(err, errInvalidCacheObject):
+			invalid++
+			fmt.Fprintf(w, "%s: %v\n", object.Name, err)
+			if errors.Is(err, errChecksumDBMismatch) {
+				if err := discardCacheObject(
+					ctx,
+					object.Name,
+					true,
+				); err != nil {
+					return err
+				}
+			}
+		default:
+			failed++
+			fmt.Fprintf(
+				w,
+				"%s: failed to verify: %v\n",
+				object.Name,
+				err,
+			)
+		}
+
+		checked++
+	}
+
+	fmt.Fprintf(
+		w,
+		"checked %d, invalid %d, missing checksums %d, failed %d\n",
+		checked,
+		invalid,
+		missingChecksums,
+		failed,
+	)
+	if missingChecksums > 0 {
+		fmt.Fprintln(
+			w,
+			"run \"cache backfill-checksums\" to store the "+
+				"missing checksums",
+		)
+	}
+
+	switch {
+	case invalid > 0 && failed > 0:
+		return fmt.Errorf(
+			"found %d invalid module files, failed to verify %d",
+			invalid,
+			failed,
+		)
+	case invalid > 0:
+		return fmt.Errorf("found %d invalid module files", invalid)
+	case failed > 0:
+		return fmt.Errorf("failed to verify %d module files", failed)
+	}
+
+	return nil
+}
+
+// moduleVersionsCachePrefix returns the prefix of the names of the cached
+// module files of the module, or an empty string if the modulePath is empty.
+func moduleVersionsCachePrefix(modulePath string) (string, error) {
+	if modulePath == "" {
+		return "", nil
+	}
+
+	escapedModulePath, err := module.EscapePath(modulePath)
+	if err != nil {
+		return "", err
+	}
+
+	return escapedModulePath + "/@v/", nil
+}
+
+// verifyCacheObject verifies the cached module file targeted by the name. The
+// returned error wraps the `errInvalidCacheObject` if the content of the
+// module file is invalid, or is the `errCacheObjectMissingChecksums` if its
+// checksums are not stored. Otherwise, the verification may be retried later.
+func verifyCacheObject(ctx context.Context, name string) error {
+	modulePath, moduleVersion, nameExt, ok := parseGoproxyCacheName(name)
+	if !ok {
+		return errors.New("invalid name")
+	}
+
+	content, objectInfo, err := objectStorage.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	f, err := os.CreateTemp("", "goproxy.cn-verify")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	if _, err := io.Copy(
+		io.MultiWriter(f, sha256Hash, md5Hash),
+		content,
+	); err != nil {
+		return err
+	}
+
+	if !objectInfo.matchChecksums(sha256Hash.Sum(nil), md5Hash.Sum(nil)) {
+		return fmt.Errorf(
+			"%w: mismatched checksum",
+			errInvalidCacheObject,
+		)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch nameExt {
+	case ".info":
+		var info struct{ Version string }
+		if err := json.NewDecoder(f).Decode(&info); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidCacheObject, err)
+		}
+
+		if !semver.IsValid(info.Version) {
+			return fmt.Errorf(
+				"%w: invalid version: %q",
+				errInvalidCacheObject,
+				info.Version,
+			)
+		}
+	case ".mod":
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		if _, err := modfile.ParseLax("go.mod", b, nil); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidCacheObject, err)
+		}
+	case ".zip":
+		if _, err := modzip.CheckZip(module.Version{
+			Path:    modulePath,
+			Version: moduleVersion,
+		}, f.Name()); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidCacheObject, err)
+		}
+	}
+
+	if err := verifyChecksumDB(name, f); err != nil {
+		if errors.Is(err, errChecksumDBMismatch) {
+			return fmt.Errorf("%w: %w", errInvalidCacheObject, err)
+		}
+
+		return err
+	}
+
+	if objectInfo.SHA256 == nil || objectInfo.MD5 == nil {
+		return errCacheObjectMissingChecksums
+	}
+
+	return nil
+}
+
+// discardCacheObject removes the cached object targeted by the name, or moves
+// it to the `quarantinePrefix` if the quarantine is true.
+func discardCacheObject(
+	ctx context.Context,
+	name string,
+	quarantine bool,
+) error {
+	if quarantine {
+		content, _, err := objectStorage.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		return quarantineCacheObject(ctx, name, content)
+	}
+
+	if err := objectStorage.Remove(ctx, name); err != nil {
+		return err
+	}
+
+	forgetCacheObject(name)
+
+	base.Logger.Warn().Str("name", name).
+		Msg("removed goproxy cache object")
+
+	return nil
+}
+
+// BackfillCacheChecksums stores the checksums of all cached module files (or
+// only those of the module if the modulePath is not empty) that were put
+// without them, and writes the backfilled ones to the w.
+func BackfillCacheChecksums(
+	ctx context.Context,
+	w io.Writer,
+	modulePath string,
+) error {
+	prefix, err := moduleVersionsCachePrefix(modulePath)
+	if err != nil {
+		return err
+	}
+
+	var checked, backfilled, failed int
+	for object, err := range objectStorage.List(ctx, prefix, "") {
+		if err != nil {
+			return err
+		}
+
+		if !validGoproxyCacheName(object.Name) {
+			continue
+		}
+
+		checked++
+
+		// The listed objects may come without their checksums.
+		objectInfo, err := objectStorage.Stat(ctx, object.Name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		if objectInfo.SHA256 != nil && objectInfo.MD5 != nil {
+			continue
+		}
+
+		if err := backfillCacheObjectChecksums(
+			ctx,
+			object.Name,
+		); err != nil {
+			failed++
+			fmt.Fprintf(w, "%s: %v\n", object.Name, err)
+			continue
+		}
+
+		backfilled++
+		fmt.Fprintln(w, object.Name)
+	}
+
+	fmt.Fprintf(
+		w,
+		"checked %d, backfilled %d, failed %d\n",
+		checked,
+		backfilled,
+		failed,
+	)
+	if failed > 0 {
+		return fmt.Errorf(
+			"failed to backfill %d module files",
+			failed,
+		)
+	}
+
+	return nil
+}
+
+// backfillCacheObjectChecksums puts the cached object targeted by the name
+// again so that its checksums are stored. The content is validated against
+// the `storageObjectInfo.ETag` first.
+func backfillCacheObjectChecksums(ctx context.Context, name string) error {
+	content, objectInfo, err := objectStorage.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	f, err := os.CreateTemp("", "goproxy.cn-backfill")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	if _, err := io.Copy(
+		io.MultiWriter(f, sha256Hash, md5Hash),
+		content,
+	); err != nil {
+		return err
+	}
+
+	if !objectInfo.matchChecksums(sha256Hash.Sum(nil), md5Hash.Sum(nil)) {
+		return fmt.Errorf(
+			"%w: mismatched checksum",
+			errInvalidCacheObject,
+		)
+	}
+
+	return objectStorage.Put(ctx, name, f)
+}
@@ -0,0 +1,335 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// quarantinePrefix is the prefix of the names of the quarantined objects in
+// the `objectStorage`. They are kept for investigation but never served.
+const quarantinePrefix = "quarantine/"
+
+var (
+	// checksumDBVerifier is used to verify the module files against the
+	// checksum database before they are cached. It is nil if disabled.
+	checksumDBVerifier *sumdb.Client
+
+	// checksumDBFailClosed indicates whether the module files that cannot
+	// be verified against the checksum database (e.g. it is unreachable
+	// or they are missing in it) are refused to be cached. Otherwise, they
+	// are cached as usual.
+	checksumDBFailClosed = base.Viper.GetBool("verification.fail_closed")
+
+	// errChecksumDBMismatch is the error of a module file that does not
+	// match the checksum database.
+	errChecksumDBMismatch = errors.New("checksum database mismatch")
+
+	// errChecksumDBUnverified is the error of a module file that cannot be
+	// verified against the checksum database.
+	errChecksumDBUnverified = errors.New(
+		"unverified by checksum database",
+	)
+)
+
+func init() {
+	if !base.Viper.GetBool("verification.enabled") {
+		return
+	}
+
+	cdbo, err := newChecksumDBOps(
+		base.Viper.GetString("verification.checksum_db"),
+	)
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to create checksum database verifier")
+	}
+
+	checksumDBVerifier = sumdb.NewClient(cdbo)
+}
+
+// checksumDBOps implements the `sumdb.ClientOps` in memory.
+type checksumDBOps struct {
+	name       string
+	key        string
+	url        string
+	httpClient *http.Client
+
+	latestMutex sync.Mutex
+	latest      []byte
+}
+
+// newChecksumDBOps returns a new instance of the `checksumDBOps` with the
+// checksumDB in the syntax of GOSUMDB.
+func newChecksumDBOps(checksumDB string) (*checksumDBOps, error) {
+	fields := strings.Fields(checksumDB)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf(
+			"invalid checksum database: %q",
+			checksumDB,
+		)
+	}
+
+	key := fields[0]
+	switch key {
+	case "sum.golang.org", "sum.golang.google.cn":
+		// go/src/cmd/go/internal/modfetch.knownGOSUMDB
+		key = "sum.golang.org" +
+			"+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+	}
+
+	name, _, _ := strings.Cut(key, "+")
+	url := "https://" + name
+	if fields[0] == "sum.golang.google.cn" {
+		url = "https://sum.golang.google.cn"
+	}
+
+	if len(fields) > 1 {
+		url = strings.TrimSuffix(fields[1], "/")
+	}
+
+	return &checksumDBOps{
+		name: name,
+		key:  key,
+		url:  url,
+		httpClient: &http.Client{
+			Transport: hhGoproxy.Transport,
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// ReadRemote implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) ReadRemote(path string) ([]byte, error) {
+	res, err := cdbo.httpClient.Get(cdbo.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"GET %s: %s: %s",
+			path,
+			res.Status,
+			bytes.TrimSpace(b),
+		)
+	}
+
+	return b, nil
+}
+
+// ReadConfig implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(cdbo.key), nil
+	}
+
+	if file == cdbo.name+"/latest" {
+		cdbo.latestMutex.Lock()
+		defer cdbo.latestMutex.Unlock()
+		return cdbo.latest, nil
+	}
+
+	return nil, fmt.Errorf("unknown config %s", file)
+}
+
+// WriteConfig implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) WriteConfig(file string, old, new []byte) error {
+	if file != cdbo.name+"/latest" {
+		return fmt.Errorf("unknown config %s", file)
+	}
+
+	cdbo.latestMutex.Lock()
+	defer cdbo.latestMutex.Unlock()
+
+	if !bytes.Equal(cdbo.latest, old) {
+		return sumdb.ErrWriteConflict
+	}
+
+	cdbo.latest = new
+
+	return nil
+}
+
+// ReadCache implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) ReadCache(file string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+// WriteCache implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) WriteCache(file string, data []byte) {}
+
+// Log implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) Log(msg string) {
+	base.Logger.Debug().Msg(msg)
+}
+
+// SecurityError implements the `sumdb.ClientOps`.
+func (cdbo *checksumDBOps) SecurityError(msg string) {
+	base.Logger.Error().Str("checksum_db", cdbo.name).
+		Msg(msg)
+}
+
+// verifyChecksumDB verifies the content of the module file targeted by the
+// name against the `checksumDBVerifier`. It does nothing if the name is not a
+// ".mod" or ".zip" file of a public module, or if the `checksumDBVerifier` is
+// nil.
+//
+// The module files that cannot be verified are only logged and counted unless
+// the `checksumDBFailClosed` is true, in which case the
+// `errChecksumDBUnverified` is returned.
+func verifyChecksumDB(name string, content io.ReadSeeker) (err error) {
+	if checksumDBVerifier == nil {
+		return nil
+	}
+
+	modulePath, moduleVersion, nameExt, ok := parseGoproxyCacheName(name)
+	if !ok || nameExt == ".info" || isPrivateModule(modulePath) {
+		return nil
+	}
+
+	defer func() {
+		result := "ok"
+		switch {
+		case errors.Is(err, errChecksumDBMismatch):
+			result = "mismatch"
+		case errors.Is(err, errChecksumDBUnverified):
+			result = "unverified"
+		case err != nil:
+			result = "error"
+		}
+
+		checksumDBVerificationsTotal.WithLabelValues(result).Inc()
+
+		if result == "unverified" && !checksumDBFailClosed {
+			base.Logger.Warn().Err(err).
+				Str("name", name).
+				Msg("failed to verify goproxy cache object " +
+					"against checksum database")
+			err = nil
+		}
+	}()
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var hash string
+	switch nameExt {
+	case ".mod":
+		b, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+
+		if hash, err = dirhash.Hash1(
+			[]string{"go.mod"},
+			func(string) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(b)), nil
+			},
+		); err != nil {
+			return err
+		}
+
+		moduleVersion += "/go.mod"
+	case ".zip":
+		f, ok := content.(*os.File)
+		if !ok {
+			f, err = os.CreateTemp("", "goproxy.cn-checksumdb")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			if _, err := io.Copy(f, content); err != nil {
+				return err
+			}
+		}
+
+		if hash, err = dirhash.HashZip(
+			f.Name(),
+			dirhash.Hash1,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	lines, err := checksumDBVerifier.Lookup(modulePath, moduleVersion)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errChecksumDBUnverified, err)
+	}
+
+	prefix := fmt.Sprint(modulePath, " ", moduleVersion, " ")
+	for _, line := range lines {
+		if wantHash, ok := strings.CutPrefix(line, prefix); ok {
+			if wantHash != hash {
+				return fmt.Errorf(
+					"%w: %s@%s: got %s, want %s",
+					errChecksumDBMismatch,
+					modulePath,
+					moduleVersion,
+					hash,
+					wantHash,
+				)
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"%w: %s@%s: missing",
+		errChecksumDBUnverified,
+		modulePath,
+		moduleVersion,
+	)
+}
+
+// quarantineCacheObject moves the cached object targeted by the name to the
+// `quarantinePrefix` with the content.
+func quarantineCacheObject(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+) error {
+	if err := objectStorage.Put(
+		ctx,
+		quarantinePrefix+name,
+		content,
+	); err != nil {
+		return err
+	}
+
+	if err := objectStorage.Remove(ctx, name); err != nil {
+		return err
+	}
+
+	forgetCacheObject(name)
+
+	base.Logger.Warn().Str("name", name).
+		Msg("quarantined goproxy cache object")
+
+	return nil
+}
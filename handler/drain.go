@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+var (
+	// drainShutdownDelay is the delay between the start of the draining
+	// and the wait for the in-flight operations, which gives the load
+	// balancers time to notice the failing readiness.
+	drainShutdownDelay = newReloadable(time.Duration(0))
+
+	// drainTimeout is the maximum time to wait for the in-flight operations
+	// before aborting them.
+	drainTimeout = newReloadable(time.Duration(0))
+
+	// storageStaleUploadMaxAge is the maximum age of the incomplete uploads
+	// in the `objectStorage` before they are aborted on startup. Zero means
+	// they are never aborted.
+	storageStaleUploadMaxAge = storageViper.GetDuration(
+		"stale_upload_max_age",
+	)
+
+	// draining indicates whether the process is draining.
+	draining atomic.Bool
+
+	// inFlightOperationCount is the number of the in-flight operations
+	// waited for by the `Drain`.
+	inFlightOperationCount atomic.Int64
+
+	// drainContext is canceled when the `drainTimeout` is exceeded, which
+	// aborts the remaining in-flight operations.
+	drainContext, cancelDrainContext = context.WithCancel(
+		context.Background(),
+	)
+)
+
+func init() {
+	loadDrainConfig(base.Viper)()
+	base.OnConfigReload([]string{
+		"health.shutdown_delay",
+		"health.drain_timeout",
+	}, func(v *viper.Viper) (func(), error) {
+		return loadDrainConfig(v), nil
+	})
+
+	base.Air.AddShutdownJob(func() {
+		draining.Store(true)
+	})
+
+	if storageStaleUploadMaxAge > 0 {
+		onStart(func() {
+			go abortStaleStorageUploads()
+		})
+	}
+}
+
+// abortStaleStorageUploads aborts the incomplete uploads to the
+// `objectStorage` older than the `storageStaleUploadMaxAge`, which are left
+// behind by the processes that did not shut down gracefully.
+func abortStaleStorageUploads() {
+	n, err := objectStorage.AbortStaleUploads(
+		base.Context,
+		storageStaleUploadMaxAge,
+	)
+	if err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to abort stale storage uploads")
+		return
+	}
+
+	if n > 0 {
+		base.Logger.Info().Int("count", n).
+			Msg("aborted stale storage uploads")
+	}
+}
+
+// loadDrainConfig loads the configuration items of the draining from the v and
+// returns a function that applies them.
+func loadDrainConfig(v *viper.Viper) func() {
+	shutdownDelay := v.GetDuration("health.shutdown_delay")
+
+	timeout := v.GetDuration("health.drain_timeout")
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+
+	return func() {
+		drainShutdownDelay.Store(shutdownDelay)
+		drainTimeout.Store(timeout)
+	}
+}
+
+// Drain marks the process as draining, which fails the readiness checks and
+// refuses new fetches. After the `drainShutdownDelay`, it waits for the
+// in-flight operations to finish and aborts them once the `drainTimeout` is
+// exceeded.
+func Drain() {
+	draining.Store(true)
+	time.Sleep(drainShutdownDelay.Load())
+
+	timer := time.NewTimer(drainTimeout.Load())
+	defer timer.Stop()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for inFlightOperationCount.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			base.Logger.Warn().
+				Int64("count", inFlightOperationCount.Load()).
+				Msg("aborting in-flight operations")
+			cancelDrainContext()
+			return
+		}
+	}
+}
+
+// trackInFlightOperation tracks an in-flight operation of the kind until the
+// returned function is called. The returned context is a copy of the ctx that
+// is canceled when the in-flight operations are aborted by the `Drain`.
+func trackInFlightOperation(
+	ctx context.Context,
+	kind string,
+) (context.Context, func()) {
+	inFlightOperationCount.Add(1)
+	inFlightOperations.WithLabelValues(kind).Inc()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(drainContext, cancel)
+
+	return ctx, func() {
+		stop()
+		cancel()
+		inFlightOperations.WithLabelValues(kind).Dec()
+		inFlightOperationCount.Add(-1)
+	}
+}
+
+// serveDraining refuses the req for the name with a 503 if the process is
+// draining and the name is not already cached. It reports whether the req has
+// been handled, otherwise the req should be served as usual.
+func serveDraining(
+	req *air.Request,
+	res *air.Response,
+	name string,
+) (bool, error) {
+	if !draining.Load() {
+		return false, nil
+	}
+
+	if validGoproxyCacheName(name) {
+		if _, err := objectStorage.Stat(req.Context, name); err == nil {
+			return false, nil
+		}
+	}
+
+	res.Status = http.StatusServiceUnavailable
+	res.Header.Set("Retry-After", "5")
+
+	return true, errors.New("draining")
+}
@@ -0,0 +1,538 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fetchLeasesPrefix is the prefix of the names of the lease objects of the
+// `storageFetchLeaser` in the `objectStorage`.
+const fetchLeasesPrefix = "locks/"
+
+// fetchLeaseSuffix is the suffix of the names of the lease objects of the
+// `storageFetchLeaser` in the `objectStorage`, which keeps them from being
+// taken as cached module files.
+const fetchLeaseSuffix = ".lock"
+
+var (
+	// goproxyFetchFlights is the fetches of the cached module files in
+	// flight in this process.
+	goproxyFetchFlights      = map[string]*goproxyFetchFlight{}
+	goproxyFetchFlightsMutex sync.Mutex
+
+	// goproxyFetchLeaser is used to share the fetches of the cached module
+	// files across replicas. It is nil if disabled.
+	goproxyFetchLeaser fetchLeaser
+
+	// goproxyFetchLeaseTTL is the TTL of the leases of the
+	// `goproxyFetchLeaser`.
+	goproxyFetchLeaseTTL = goproxyViper.GetDuration("fetch_lease_ttl")
+
+	// goproxyFetchLeasePollInterval is the interval at which the replicas
+	// waiting for a fetch leased by another replica check its result.
+	goproxyFetchLeasePollInterval = time.Second
+)
+
+func init() {
+	if goproxyFetchLeaseTTL <= 0 {
+		goproxyFetchLeaseTTL = goproxyFetchTimeout.Load() + time.Minute
+	}
+
+	backend := goproxyViper.GetString("fetch_lease_backend")
+	switch backend {
+	case "":
+	case "storage":
+		sfl, err := newStorageFetchLeaser()
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to create storage fetch leaser")
+		}
+
+		goproxyFetchLeaser = sfl
+	default:
+		base.Logger.Fatal().Str("backend", backend).
+			Msg("unknown goproxy fetch lease backend")
+	}
+}
+
+// goproxyFetchFlight is a fetch of a cached module file in flight in this
+// process.
+type goproxyFetchFlight struct {
+	// done is closed when the fetch ends.
+	done chan struct{}
+
+	// cached indicates whether the fetched file has been cached, so that
+	// its waiters can look it up again. Otherwise (e.g. it is too large
+	// to be cached), they fetch it themselves. It is set before the done
+	// is closed.
+	cached bool
+
+	// err is the error of the fetch if it failed, which is shared with
+	// its waiters. It is set before the done is closed.
+	err *goproxyFetchError
+}
+
+// goproxyFetchError is the error response of a failed fetch.
+type goproxyFetchError struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Error implements the `error`.
+func (gfe *goproxyFetchError) Error() string {
+	if body := bytes.TrimSpace(gfe.body); len(body) > 0 {
+		return fmt.Sprintf("fetch failed: %d %s", gfe.status, body)
+	}
+
+	return fmt.Sprintf(
+		"fetch failed: %d %s",
+		gfe.status,
+		http.StatusText(gfe.status),
+	)
+}
+
+// goproxyFetchLeaderContextKey is the context key of the `goproxyFetchLeader`.
+type goproxyFetchLeaderContextKey struct{}
+
+// goproxyFetchLeader is the leader of the fetches started while serving a
+// request through the `hhGoproxy`.
+type goproxyFetchLeader struct {
+	ctx    context.Context
+	mutex  sync.Mutex
+	names  map[string]bool
+	leased map[string]bool
+	spans  map[string]trace.Span
+
+	// waited is the names of the fetches led by other requests that the
+	// request of the gfl has waited for. They are never waited for or led
+	// again, so that the request does not queue behind the next fetch.
+	waited map[string]bool
+
+	// sharedErr is the error of the fetch led by another request that
+	// the request of the gfl has waited for, if it failed.
+	sharedErr *goproxyFetchError
+}
+
+// withGoproxyFetchLeader returns a copy of the ctx with a new
+// `goproxyFetchLeader` and a function that ends all fetches it leads with the
+// error (nil if none) of the request.
+func withGoproxyFetchLeader(
+	ctx context.Context,
+) (context.Context, func(err *goproxyFetchError)) {
+	gfl := &goproxyFetchLeader{
+		ctx:    ctx,
+		names:  map[string]bool{},
+		leased: map[string]bool{},
+		spans:  map[string]trace.Span{},
+		waited: map[string]bool{},
+	}
+
+	return context.WithValue(ctx, goproxyFetchLeaderContextKey{}, gfl),
+		func(err *goproxyFetchError) {
+			gfl.mutex.Lock()
+			names := make([]string, 0, len(gfl.names))
+			for name := range gfl.names {
+				names = append(names, name)
+			}
+			gfl.mutex.Unlock()
+
+			for _, name := range names {
+				gfl.end(name, false, err)
+			}
+		}
+}
+
+// goproxyFetchLeaderFromContext returns the `goproxyFetchLeader` in the ctx, or
+// nil if not found.
+func goproxyFetchLeaderFromContext(ctx context.Context) *goproxyFetchLeader {
+	gfl, _ := ctx.Value(
+		goproxyFetchLeaderContextKey{},
+	).(*goproxyFetchLeader)
+	return gfl
+}
+
+// end ends the fetch of the name led by the gfl, which wakes up its waiters.
+// The cached reports whether the fetched file has been cached, and the err is
+// the error of the fetch (nil if it succeeded).
+func (gfl *goproxyFetchLeader) end(
+	name string,
+	cached bool,
+	err *goproxyFetchError,
+) {
+	gfl.mutex.Lock()
+	led, leased, span := gfl.names[name], gfl.leased[name], gfl.spans[name]
+	delete(gfl.names, name)
+	delete(gfl.leased, name)
+	delete(gfl.spans, name)
+	gfl.mutex.Unlock()
+
+	if !led {
+		return
+	}
+
+	if span != nil {
+		span.End()
+	}
+
+	goproxyFetchFlightsMutex.Lock()
+	flight := goproxyFetchFlights[name]
+	flight.cached = cached
+	flight.err = err
+	close(flight.done)
+	delete(goproxyFetchFlights, name)
+	goproxyFetchFlightsMutex.Unlock()
+
+	if leased {
+		if err := goproxyFetchLeaser.Release(
+			context.WithoutCancel(base.Context),
+			name,
+		); err != nil {
+			base.Logger.Error().Err(err).Str("name", name).
+				Msg("failed to release goproxy fetch lease")
+		}
+	}
+}
+
+// startGoproxyFetch records the start of the fetch of the name after it misses
+// the cache, which takes a fetch token of the rate limits, is logged in the
+// access logs and, if led by the `goproxyFetchLeader` in the ctx, is traced as
+// a span until it ends.
+func startGoproxyFetch(ctx context.Context, name string) {
+	takeRateLimitFetch(ctx, name)
+	accessLogEntryFromContext(ctx).startFetch()
+
+	gfl := goproxyFetchLeaderFromContext(ctx)
+	if gfl == nil {
+		return
+	}
+
+	gfl.mutex.Lock()
+	defer gfl.mutex.Unlock()
+	if gfl.names[name] && gfl.spans[name] == nil {
+		_, gfl.spans[name] = base.Tracer.Start(
+			gfl.ctx,
+			"goproxy.fetch",
+			trace.WithAttributes(
+				attribute.String("goproxy.name", name),
+			),
+		)
+	}
+}
+
+// awaitGoproxyFetch waits for the fetch of the cached module file targeted by
+// the name if it is in flight in this process or, if the
+// `goproxyFetchLeaser` is enabled, leased by another replica. It reports
+// whether it has waited, in which case the cache should be looked up again.
+// Otherwise, the `goproxyFetchLeader` in the ctx (if any) becomes the leader
+// of the fetch, unless it has already waited for the fetch of the name in this
+// process, which has not cached the file.
+//
+// The error of the fetch in flight in this process is returned if it failed,
+// so that its waiters do not fetch again one after another. Likewise, if the
+// fetch has not cached the file, it reports that it has not waited, so that
+// its waiters fetch the file at the same time without leading the fetch.
+func awaitGoproxyFetch(ctx context.Context, name string) (bool, error) {
+	gfl := goproxyFetchLeaderFromContext(ctx)
+	if gfl == nil || ctx.Err() != nil || !validGoproxyCacheName(name) {
+		return false, nil
+	}
+
+	// The gfl may already lead the fetch if it has waited for another
+	// replica before acquiring the lease.
+	gfl.mutex.Lock()
+	led, waitedLocally := gfl.names[name], gfl.waited[name]
+	gfl.mutex.Unlock()
+	if led || waitedLocally {
+		return false, nil
+	}
+
+	goproxyFetchFlightsMutex.Lock()
+	flight, ok := goproxyFetchFlights[name]
+	if !ok {
+		goproxyFetchFlights[name] = &goproxyFetchFlight{
+			done: make(chan struct{}),
+		}
+	}
+	goproxyFetchFlightsMutex.Unlock()
+
+	if ok {
+		goproxyFetchWaitsTotal.WithLabelValues("local").Inc()
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+			return true, nil
+		}
+
+		gfl.mutex.Lock()
+		gfl.waited[name] = true
+		if flight.err != nil {
+			gfl.sharedErr = flight.err
+		}
+		gfl.mutex.Unlock()
+
+		if flight.err != nil {
+			return true, flight.err
+		}
+
+		return flight.cached, nil
+	}
+
+	gfl.mutex.Lock()
+	gfl.names[name] = true
+	gfl.mutex.Unlock()
+
+	if goproxyFetchLeaser == nil {
+		return false, nil
+	}
+
+	waited := false
+	for {
+		acquired, err := goproxyFetchLeaser.Acquire(
+			ctx,
+			name,
+			goproxyFetchLeaseTTL,
+		)
+		if err != nil {
+			base.Logger.Error().Err(err).Str("name", name).
+				Msg("failed to acquire goproxy fetch lease")
+			return waited, nil
+		}
+
+		if acquired {
+			gfl.mutex.Lock()
+			gfl.leased[name] = true
+			gfl.mutex.Unlock()
+			return waited, nil
+		}
+
+		if !waited {
+			goproxyFetchWaitsTotal.WithLabelValues("remote").Inc()
+			waited = true
+		}
+
+		select {
+		case <-time.After(goproxyFetchLeasePollInterval):
+		case <-ctx.Done():
+			return true, nil
+		}
+
+		if _, err := objectStorage.Stat(ctx, name); err == nil {
+			if goproxyNegativeCache != nil {
+				goproxyNegativeCache.Remove(name)
+			}
+
+			return true, nil
+		}
+	}
+}
+
+// goproxyFetchResponseWriter implements the `http.ResponseWriter` to record the
+// error response of a request served as the `goproxyFetchLeader`, and to
+// respond with the error of the fetch it has waited for instead of the internal
+// server error of the `hhGoproxy`.
+type goproxyFetchResponseWriter struct {
+	http.ResponseWriter
+
+	gfl    *goproxyFetchLeader
+	status int
+	header http.Header
+	body   bytes.Buffer
+	shared bool
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (gfrw *goproxyFetchResponseWriter) WriteHeader(status int) {
+	if gfrw.status != 0 {
+		return
+	}
+
+	gfrw.status = status
+
+	gfrw.gfl.mutex.Lock()
+	sharedErr := gfrw.gfl.sharedErr
+	gfrw.gfl.mutex.Unlock()
+	if status == http.StatusInternalServerError && sharedErr != nil {
+		gfrw.shared = true
+
+		header := gfrw.ResponseWriter.Header()
+		clear(header)
+		maps.Copy(header, sharedErr.header)
+		gfrw.ResponseWriter.WriteHeader(sharedErr.status)
+		gfrw.ResponseWriter.Write(sharedErr.body)
+
+		return
+	}
+
+	if status >= http.StatusBadRequest {
+		gfrw.header = gfrw.ResponseWriter.Header().Clone()
+		gfrw.header.Del("Content-Length")
+	}
+
+	gfrw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the `http.ResponseWriter`.
+func (gfrw *goproxyFetchResponseWriter) Write(b []byte) (int, error) {
+	gfrw.WriteHeader(http.StatusOK)
+	if gfrw.shared {
+		return len(b), nil
+	}
+
+	if gfrw.status >= http.StatusBadRequest && gfrw.body.Len() < 4096 {
+		gfrw.body.Write(b)
+	}
+
+	return gfrw.ResponseWriter.Write(b)
+}
+
+// fetchError returns the error response recorded by the gfrw, or nil if the
+// request succeeded, it has been canceled or its response is shared.
+func (gfrw *goproxyFetchResponseWriter) fetchError() *goproxyFetchError {
+	if gfrw.status < http.StatusBadRequest || gfrw.shared ||
+		gfrw.gfl.ctx.Err() != nil {
+		return nil
+	}
+
+	return &goproxyFetchError{
+		status: gfrw.status,
+		header: gfrw.header,
+		body:   bytes.Clone(gfrw.body.Bytes()),
+	}
+}
+
+// fetchLeaser defines a set of methods used to manage the leases of the fetches
+// of the cached module files across replicas.
+type fetchLeaser interface {
+	// Acquire tries to acquire the lease of the name for the ttl. It
+	// reports whether the lease is acquired.
+	Acquire(ctx context.Context, name string, ttl time.Duration) (
+		bool,
+		error,
+	)
+
+	// Release releases the lease of the name if it is held.
+	Release(ctx context.Context, name string) error
+}
+
+// storageFetchLeaser implements the `fetchLeaser` using the lease objects in
+// the `objectStorage`.
+//
+// Note that the `objectStorage` does not support conditional writes, so two
+// replicas may still both acquire a lease in a narrow window. This is fine as
+// a duplicate fetch is harmless.
+type storageFetchLeaser struct {
+	owner string
+}
+
+// storageFetchLease is a lease object of the `storageFetchLeaser`.
+type storageFetchLease struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// newStorageFetchLeaser returns a new instance of the `storageFetchLeaser`.
+func newStorageFetchLeaser() (*storageFetchLeaser, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return &storageFetchLeaser{
+		owner: fmt.Sprint(
+			hostname,
+			"-",
+			os.Getpid(),
+			"-",
+			hex.EncodeToString(b),
+		),
+	}, nil
+}
+
+// Acquire implements the `fetchLeaser`.
+func (sfl *storageFetchLeaser) Acquire(
+	ctx context.Context,
+	name string,
+	ttl time.Duration,
+) (bool, error) {
+	if lease, err := sfl.lease(ctx, name); err != nil {
+		return false, err
+	} else if lease.Owner != "" && lease.Owner != sfl.owner &&
+		time.Now().Before(lease.ExpiresAt) {
+		return false, nil
+	}
+
+	if err := putJSONObject(
+		ctx,
+		sfl.objectName(name),
+		storageFetchLease{
+			Owner:     sfl.owner,
+			ExpiresAt: time.Now().Add(ttl).UTC(),
+		},
+	); err != nil {
+		return false, err
+	}
+
+	// Read back in case another replica has just put its lease.
+	lease, err := sfl.lease(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	return lease.Owner == sfl.owner, nil
+}
+
+// Release implements the `fetchLeaser`.
+func (sfl *storageFetchLeaser) Release(
+	ctx context.Context,
+	name string,
+) error {
+	lease, err := sfl.lease(ctx, name)
+	if err != nil || lease.Owner != sfl.owner {
+		return err
+	}
+
+	return objectStorage.Remove(ctx, sfl.objectName(name))
+}
+
+// objectName returns the name of the lease object of the name.
+func (sfl *storageFetchLeaser) objectName(name string) string {
+	return fetchLeasesPrefix + name + fetchLeaseSuffix
+}
+
+// lease returns the lease object of the name. An empty lease is returned if
+// not found.
+func (sfl *storageFetchLeaser) lease(
+	ctx context.Context,
+	name string,
+) (storageFetchLease, error) {
+	var lease storageFetchLease
+	if err := getJSONObject(
+		ctx,
+		sfl.objectName(name),
+		&lease,
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return storageFetchLease{}, err
+	}
+
+	return lease, nil
+}
@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fileSystemStorageFileSuffix is the suffix of the local filenames of the
+// objects in the `fileSystemStorage`. It allows an object name to also be the
+// prefix of other object names (e.g. "stats/golang.org/x/text" and
+// "stats/golang.org/x/text/badges/download-count.svg"), as the "%" never
+// appears in any module path or escaped module version.
+const fileSystemStorageFileSuffix = "%"
+
+// fileSystemStorageChecksumsFileSuffix is the suffix of the local filenames of
+// the checksums of the objects in the `fileSystemStorage`. They are ignored by
+// the `fileSystemStorage.List` as they do not end with the
+// `fileSystemStorageFileSuffix`.
+const fileSystemStorageChecksumsFileSuffix = fileSystemStorageFileSuffix +
+	".checksums"
+
+// fileSystemStorageChecksums is the checksums of an object in the
+// `fileSystemStorage`.
+type fileSystemStorageChecksums struct {
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+}
+
+// fileSystemStorage implements the `storage` using a directory on the local
+// disk. If the directory does not exist, it will be created with 0750
+// permissions.
+type fileSystemStorage struct {
+	root string
+}
+
+// newFileSystemStorage returns a new instance of the `fileSystemStorage` with
+// the root.
+func newFileSystemStorage(root string) (*fileSystemStorage, error) {
+	if root == "" {
+		return nil, errors.New("missing filesystem storage root")
+	}
+
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &fileSystemStorage{root: root}, nil
+}
+
+// Get implements the `storage`.
+func (fss *fileSystemStorage) Get(ctx context.Context, name string) (
+	io.ReadSeekCloser,
+	storageObjectInfo,
+	error,
+) {
+	f, err := os.Open(fss.filename(name))
+	if err != nil {
+		return nil, storageObjectInfo{}, fss.convertError(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, storageObjectInfo{}, err
+	} else if fi.IsDir() {
+		f.Close()
+		return nil, storageObjectInfo{}, fs.ErrNotExist
+	}
+
+	return f, fss.storageObjectInfo(name, fi), nil
+}
+
+// Stat implements the `storage`.
+func (fss *fileSystemStorage) Stat(
+	ctx context.Context,
+	name string,
+) (storageObjectInfo, error) {
+	fi, err := os.Stat(fss.filename(name))
+	if err != nil {
+		return storageObjectInfo{}, fss.convertError(err)
+	} else if fi.IsDir() {
+		return storageObjectInfo{}, fs.ErrNotExist
+	}
+
+	return fss.storageObjectInfo(name, fi), nil
+}
+
+// Put implements the `storage`.
+func (fss *fileSystemStorage) Put(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+) error {
+	sha256Checksum, md5Checksum, err := storageContentChecksums(content)
+	if err != nil {
+		return err
+	}
+
+	checksums, err := json.Marshal(fileSystemStorageChecksums{
+		SHA256: hex.EncodeToString(sha256Checksum),
+		MD5:    hex.EncodeToString(md5Checksum),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Never leave the checksums of the replaced content.
+	checksumsFilename := fss.checksumsFilename(name)
+	if err := os.Remove(checksumsFilename); err != nil &&
+		!errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := fss.writeFile(fss.filename(name), content); err != nil {
+		return err
+	}
+
+	return fss.writeFile(checksumsFilename, bytes.NewReader(checksums))
+}
+
+// Remove implements the `storage`.
+func (fss *fileSystemStorage) Remove(ctx context.Context, name string) error {
+	if err := os.Remove(fss.filename(name)); err != nil &&
+		!errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Remove(
+		fss.checksumsFilename(name),
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// List implements the `storage`.
+func (fss *fileSystemStorage) List(
+	ctx context.Context,
+	prefix string,
+	startAfter string,
+) iter.Seq2[storageObjectInfo, error] {
+	return func(yield func(storageObjectInfo, error) bool) {
+		dir := prefix
+		if !strings.HasSuffix(dir, "/") {
+			dir = path.Dir(dir)
+		}
+
+		var names []string
+		if err := filepath.WalkDir(
+			filepath.Join(fss.root, filepath.FromSlash(dir)),
+			func(filename string, de fs.DirEntry, err error) error {
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						return nil
+					}
+
+					return err
+				}
+
+				if de.IsDir() ||
+					strings.HasPrefix(de.Name(), ".") ||
+					!strings.HasSuffix(
+						de.Name(),
+						fileSystemStorageFileSuffix,
+					) {
+					return nil
+				}
+
+				rel, err := filepath.Rel(fss.root, filename)
+				if err != nil {
+					return err
+				}
+
+				name := strings.TrimSuffix(
+					filepath.ToSlash(rel),
+					fileSystemStorageFileSuffix,
+				)
+				if strings.HasPrefix(name, prefix) &&
+					name > startAfter {
+					names = append(names, name)
+				}
+
+				return ctx.Err()
+			},
+		); err != nil {
+			yield(storageObjectInfo{}, err)
+			return
+		}
+
+		slices.Sort(names)
+		for _, name := range names {
+			info, err := fss.Stat(ctx, name)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			if !yield(info, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// AbortStaleUploads implements the `storage`. The incomplete uploads are the
+// temporary files left behind by the `fileSystemStorage.writeFile`.
+func (fss *fileSystemStorage) AbortStaleUploads(
+	ctx context.Context,
+	maxAge time.Duration,
+) (int, error) {
+	var (
+		count  int
+		cutoff = time.Now().Add(-maxAge)
+	)
+
+	err := filepath.WalkDir(
+		fss.root,
+		func(filename string, de fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+
+				return err
+			}
+
+			if de.IsDir() || !strings.HasPrefix(de.Name(), ".") ||
+				!strings.Contains(de.Name(), ".tmp") {
+				return nil
+			}
+
+			fi, err := de.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+
+				return err
+			}
+
+			if fi.ModTime().After(cutoff) {
+				return nil
+			}
+
+			if err := os.Remove(filename); err != nil &&
+				!errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+
+			count++
+
+			return ctx.Err()
+		},
+	)
+
+	return count, err
+}
+
+// Presign implements the `storage`.
+func (fss *fileSystemStorage) Presign(
+	ctx context.Context,
+	method string,
+	name string,
+	expiry time.Duration,
+	reqParams url.Values,
+) (*url.URL, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// filename returns the local filename of the object targeted by the name.
+func (fss *fileSystemStorage) filename(name string) string {
+	return filepath.Join(
+		fss.root,
+		filepath.FromSlash(path.Clean("/"+name)),
+	) + fileSystemStorageFileSuffix
+}
+
+// checksumsFilename returns the local filename of the checksums of the object
+// targeted by the name.
+func (fss *fileSystemStorage) checksumsFilename(name string) string {
+	return strings.TrimSuffix(
+		fss.filename(name),
+		fileSystemStorageFileSuffix,
+	) + fileSystemStorageChecksumsFileSuffix
+}
+
+// writeFile writes the content to the local file targeted by the filename
+// atomically.
+func (fss *fileSystemStorage) writeFile(
+	filename string,
+	content io.Reader,
+) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, fmt.Sprintf(
+		".%s.tmp*",
+		filepath.Base(filename),
+	))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// convertError converts the err into the `fs.ErrNotExist` if it is a not
+// exist error.
+func (fss *fileSystemStorage) convertError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fs.ErrNotExist
+	}
+
+	return err
+}
+
+// storageObjectInfo returns the `storageObjectInfo` of the object targeted by
+// the name with the fi.
+func (fss *fileSystemStorage) storageObjectInfo(
+	name string,
+	fi fs.FileInfo,
+) storageObjectInfo {
+	soi := storageObjectInfo{
+		Name: name,
+		Size: fi.Size(),
+		ETag: fmt.Sprintf(
+			"%x-%x",
+			fi.ModTime().UnixNano(),
+			fi.Size(),
+		),
+		ContentType:  storageContentType(name),
+		LastModified: fi.ModTime(),
+	}
+
+	var checksums fileSystemStorageChecksums
+	if b, err := os.ReadFile(
+		fss.checksumsFilename(name),
+	); err == nil && json.Unmarshal(b, &checksums) == nil {
+		soi.SHA256, soi.MD5 = parseStorageContentChecksums(
+			checksums.SHA256,
+			checksums.MD5,
+		)
+	}
+
+	return soi
+}
@@ -1,9 +1,11 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"io"
 	"io/fs"
 	"log"
@@ -12,26 +14,29 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy"
 	"github.com/goproxy/goproxy.cn/base"
-	"github.com/minio/minio-go/v7"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 )
 
 var (
 	// goproxyViper is used to get the configuration items of the Goproxy.
-	goproxyViper = base.Viper.Sub("goproxy")
+	goproxyViper = base.SubViper("goproxy")
 
 	// hhGoproxy is an instance of the `goproxy.Goproxy`.
 	hhGoproxy = &goproxy.Goproxy{
-		GoBinName:           goproxyViper.GetString("go_bin_name"),
-		Cacher:              &goproxyCacher{},
-		CacherMaxCacheBytes: goproxyViper.GetInt("cacher_max_cache_bytes"),
-		ProxiedSUMDBs:       goproxyViper.GetStringSlice("proxied_sumdbs"),
+		GoBinName:     goproxyViper.GetString("go_bin_name"),
+		Cacher:        &goproxyCacher{},
+		ProxiedSUMDBs: goproxyViper.GetStringSlice("proxied_sumdbs"),
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			DialContext: (&net.Dialer{
@@ -48,104 +53,109 @@ var (
 		ErrorLogger: log.New(base.Logger, "", 0),
 	}
 
+	// goproxyCacherMaxCacheBytes is the maximum size of the module files
+	// stored by the `goproxyCacher`. It is enforced by the
+	// `goproxyCacher.Put` rather than the `hhGoproxy`, which would not
+	// pass the larger ones to it, so that they are still verified against
+	// the checksum database before being served.
+	goproxyCacherMaxCacheBytes = goproxyViper.GetInt64(
+		"cacher_max_cache_bytes",
+	)
+
 	// goproxyFetchTimeout is the maximum duration allowed for Goproxy to
 	// fetch a module.
-	goproxyFetchTimeout = goproxyViper.GetDuration("fetch_timeout")
+	goproxyFetchTimeout = newReloadable(
+		goproxyViper.GetDuration("fetch_timeout"),
+	)
 
 	// goproxyAutoRedirect indicates whether the automatic redirection
 	// feature is enabled for Goproxy.
 	goproxyAutoRedirect = goproxyViper.GetBool("auto_redirect")
 
-	// goproxyAutoRedirectMinSize is the minimum size of the Goproxy used to
-	// limit at least how big Goproxy cache can be automatically redirected.
-	goproxyAutoRedirectMinSize = goproxyViper.GetInt64("auto_redirect_min_size")
+	// servedGoproxy is the instance of the `goproxy.Goproxy` that serves
+	// the requests. It starts as the `hhGoproxy` and is replaced when the
+	// upstreams are reloaded.
+	servedGoproxy atomic.Pointer[goproxy.Goproxy]
 )
 
 func init() {
-	base.Air.BATCH(getHeadMethods, "/*", hGoproxy)
+	servedGoproxy.Store(hhGoproxy)
+
+	base.OnConfigReload([]string{"goproxy.fetch_timeout"}, func(
+		v *viper.Viper,
+	) (func(), error) {
+		fetchTimeout := v.GetDuration("goproxy.fetch_timeout")
+		return func() {
+			goproxyFetchTimeout.Store(fetchTimeout)
+		}, nil
+	})
+
+	base.Air.BATCH(
+		getHeadMethods,
+		"/*",
+		hGoproxy,
+		metricsGas("hGoproxy"),
+		authGas,
+		rateLimitGas,
+	)
 }
 
 // hGoproxy handles requests to play with Go module proxy.
 func hGoproxy(req *air.Request, res *air.Response) error {
-	if goproxyFetchTimeout != 0 {
+	if fetchTimeout := goproxyFetchTimeout.Load(); fetchTimeout != 0 {
 		var cancel context.CancelFunc
 		req.Context, cancel = context.WithTimeout(
 			req.Context,
-			goproxyFetchTimeout,
+			fetchTimeout,
 		)
 		defer cancel()
 	}
 
+	// Only the canonical names are served, so that the checks below
+	// (e.g. the module rules) cannot be bypassed by the aliases of a name
+	// (e.g. "a//b" or "a/./b").
 	name, err := url.PathUnescape(req.ParamValue("*").String())
-	if err != nil || strings.HasSuffix(name, "/") {
+	if err != nil || path.Clean(name) != name {
 		return CacheableNotFound(req, res, 86400)
 	}
 
 	req.Header.Del("Disable-Module-Fetch")
 
-	if !goproxyAutoRedirect || path.Ext(name) != ".zip" {
-		hhGoproxy.ServeHTTP(res.HTTPResponseWriter(), req.HTTPRequest())
-		return nil
+	accessLogEntryFromContext(req.Context).setName(name)
+	annotateGoproxySpan(req.Context, name)
+
+	if handled, err := serveModuleRules(req, res, name); handled {
+		return err
 	}
 
-	if strings.Contains(name, "..") {
-		for _, part := range strings.Split(name, "/") {
-			if part == ".." {
-				return CacheableNotFound(req, res, 86400)
+	if path.Ext(name) == ".zip" {
+		defer func() {
+			if req.Method != http.MethodGet || !res.Written {
+				return
 			}
-		}
-	}
 
-	name = strings.TrimPrefix(path.Clean(name), "/")
-	if !validGoproxyCacheName(name) {
-		return CacheableNotFound(req, res, 86400)
+			switch res.Status {
+			case http.StatusOK, http.StatusFound:
+				recordModuleDownload(name)
+			}
+		}()
 	}
 
-	var objectInfo minio.ObjectInfo
-	if err := retryQiniuKodoDo(req.Context, func(
-		ctx context.Context,
-	) (err error) {
-		objectInfo, err = qiniuKodoClient.StatObject(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.StatObjectOptions{},
-		)
-		return err
-	}); err != nil {
-		if isNotFoundMinIOError(err) {
-			hhGoproxy.ServeHTTP(
-				res.HTTPResponseWriter(),
-				req.HTTPRequest(),
-			)
-			return nil
-		}
-
+	if handled, err := serveRedirect(req, res, name); handled {
 		return err
 	}
 
-	if objectInfo.Size < goproxyAutoRedirectMinSize {
-		hhGoproxy.ServeHTTP(res.HTTPResponseWriter(), req.HTTPRequest())
-		return nil
+	if handled, err := serveDraining(req, res, name); handled {
+		return err
 	}
 
-	u, err := qiniuKodoClient.Presign(
-		req.Context,
-		req.Method,
-		qiniuKodoBucketName,
-		objectInfo.Key,
-		7*24*time.Hour,
-		url.Values{
-			"response-cache-control": []string{
-				"public, max-age=604800",
-			},
-		},
-	)
-	if err != nil {
+	if handled, err := serveRateLimit(req, res, name); handled {
 		return err
 	}
 
-	return res.Redirect(u.String())
+	serveGoproxy(res.HTTPResponseWriter(), req.HTTPRequest())
+
+	return nil
 }
 
 // goproxyCacher implements the `goproxy.Cacher`.
@@ -156,47 +166,111 @@ func (gc *goproxyCacher) Get(
 	ctx context.Context,
 	name string,
 ) (io.ReadCloser, error) {
-	var (
-		object     *minio.Object
-		objectInfo minio.ObjectInfo
+	ctx, span := base.Tracer.Start(
+		ctx,
+		"goproxyCacher.Get",
+		trace.WithAttributes(attribute.String("goproxy.name", name)),
 	)
+	defer span.End()
+
+	for {
+		content, err := gc.get(ctx, name)
+		if err == nil {
+			span.SetAttributes(attribute.String(
+				"goproxy.cache_outcome",
+				accessLogCacheOutcomeHit,
+			))
+			accessLogEntryFromContext(ctx).setCacheOutcome(
+				accessLogCacheOutcomeHit,
+			)
+		}
 
-	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
-		object, err = qiniuKodoClient.GetObject(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.GetObjectOptions{},
-		)
-		if err != nil {
-			return err
+		if !errors.Is(err, fs.ErrNotExist) {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+
+			return content, err
 		}
 
-		objectInfo, err = object.Stat()
-		if err != nil {
-			object.Close()
+		waited, fetchErr := awaitGoproxyFetch(ctx, name)
+		if fetchErr != nil {
+			span.RecordError(fetchErr)
+			span.SetStatus(codes.Error, fetchErr.Error())
+			return nil, fetchErr
 		}
 
-		return err
-	}); err != nil {
-		if isNotFoundMinIOError(err) {
+		if !waited {
+			span.SetAttributes(attribute.String(
+				"goproxy.cache_outcome",
+				accessLogCacheOutcomeMiss,
+			))
+			startGoproxyFetch(ctx, name)
+			return content, err
+		}
+	}
+}
+
+// get gets the cache targeted by the name from the tiers of the gc.
+func (gc *goproxyCacher) get(
+	ctx context.Context,
+	name string,
+) (io.ReadCloser, error) {
+	if goproxyNegativeCache != nil && goproxyNegativeCache.Contains(name) {
+		cacheLookupsTotal.WithLabelValues("negative_hit").Inc()
+		return nil, fs.ErrNotExist
+	}
+
+	if goproxyLocalCache != nil {
+		content, objectInfo, err := goproxyLocalCache.Get(ctx, name)
+		if err == nil {
+			cacheLookupsTotal.WithLabelValues("local_hit").Inc()
+			return newGoproxyCacheReader(content, objectInfo), nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	content, objectInfo, err := objectStorage.Get(ctx, name)
+	if err != nil {
+		if errors.Is(err, errStorageCircuitOpen) {
+			// Falls through to a direct fetch.
+			cacheLookupsTotal.WithLabelValues("bypass").Inc()
 			return nil, fs.ErrNotExist
+		} else if errors.Is(err, fs.ErrNotExist) {
+			cacheLookupsTotal.WithLabelValues("miss").Inc()
+			if goproxyNegativeCache != nil {
+				goproxyNegativeCache.Add(name)
+			}
 		}
 
 		return nil, err
 	}
 
-	checksum, _ := hex.DecodeString(objectInfo.ETag)
-	if len(checksum) != md5.Size {
-		eTagChecksum := md5.Sum([]byte(objectInfo.ETag))
-		checksum = eTagChecksum[:]
+	cacheLookupsTotal.WithLabelValues("hit").Inc()
+
+	if goproxyLocalCache != nil &&
+		objectInfo.Size <= goproxyLocalCache.maxFileBytes {
+		localContent, err := goproxyLocalCache.Put(objectInfo, content)
+		if err == nil {
+			content.Close()
+			return newGoproxyCacheReader(
+				localContent,
+				objectInfo,
+			), nil
+		}
+
+		base.Logger.Warn().Err(err).Str("name", name).
+			Msg("failed to put goproxy local cache")
+
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			content.Close()
+			return nil, err
+		}
 	}
 
-	return &goproxyCacheReader{
-		ReadSeekCloser: object,
-		modTime:        objectInfo.LastModified,
-		checksum:       checksum,
-	}, nil
+	return newGoproxyCacheReader(content, objectInfo), nil
 }
 
 // Put implements the `goproxy.Cacher`.
@@ -205,21 +279,67 @@ func (gc *goproxyCacher) Put(
 	name string,
 	content io.ReadSeeker,
 ) error {
-	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-		_, err := qiniuKodoClient.StatObject(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.StatObjectOptions{},
-		)
-		return err
-	}); err == nil {
+	// The fetch must not end before the negative cache is removed, and
+	// its waiters only look the file up again if it has been cached.
+	cached := false
+	if gfl := goproxyFetchLeaderFromContext(ctx); gfl != nil {
+		defer func() {
+			gfl.end(name, cached, nil)
+		}()
+	}
+
+	if goproxyNegativeCache != nil {
+		defer goproxyNegativeCache.Remove(name)
+	}
+
+	accessLogEntryFromContext(ctx).endFetch()
+
+	if _, err := objectStorage.Stat(ctx, name); err == nil {
+		cached = true
+		return nil
+	} else if errors.Is(err, errStorageCircuitOpen) {
+		// The fetched content is still served, just not cached.
 		return nil
-	} else if !isNotFoundMinIOError(err) {
+	} else if !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	return qiniuKodoUpload(ctx, name, content)
+	if err := verifyChecksumDB(name, content); err != nil {
+		if errors.Is(err, errChecksumDBMismatch) {
+			if err := quarantineCacheObject(
+				ctx,
+				name,
+				content,
+			); err != nil {
+				base.Logger.Error().Err(err).
+					Str("name", name).
+					Msg("failed to quarantine goproxy " +
+						"cache object")
+			}
+		}
+
+		return err
+	}
+
+	if goproxyCacherMaxCacheBytes > 0 {
+		size, err := content.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		} else if size > goproxyCacherMaxCacheBytes {
+			return nil // Served but not cached
+		} else if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	err := objectStorage.Put(ctx, name, content)
+	if errors.Is(err, errStorageCircuitOpen) {
+		return nil
+	}
+
+	cached = err == nil
+
+	return err
 }
 
 // goproxyCacheReader is the reader of the cache unit of the `goproxyCacher`.
@@ -230,40 +350,196 @@ type goproxyCacheReader struct {
 	checksum []byte
 }
 
+// newGoproxyCacheReader returns a new instance of the `goproxyCacheReader` with
+// the content of the object described by the objectInfo.
+func newGoproxyCacheReader(
+	content io.ReadSeekCloser,
+	objectInfo storageObjectInfo,
+) *goproxyCacheReader {
+	checksum := objectInfo.SHA256
+	if checksum == nil {
+		checksum, _ = hex.DecodeString(objectInfo.ETag)
+		if len(checksum) != md5.Size {
+			eTagChecksum := md5.Sum([]byte(objectInfo.ETag))
+			checksum = eTagChecksum[:]
+		}
+	}
+
+	return &goproxyCacheReader{
+		ReadSeekCloser: content,
+		modTime:        objectInfo.LastModified,
+		checksum:       checksum,
+	}
+}
+
+// Read implements the `io.Reader`.
+func (gcr *goproxyCacheReader) Read(b []byte) (int, error) {
+	n, err := gcr.ReadSeekCloser.Read(b)
+	cacheServedBytesTotal.Add(float64(n))
+	return n, err
+}
+
 // ModTime returns the modification time of the gcr.
 func (gcr *goproxyCacheReader) ModTime() time.Time {
 	return gcr.modTime
 }
 
-// Checksum returns the checksum of the gcr.
-func (gcr *goproxyCacheReader) Checksum() []byte {
-	return gcr.checksum
+// ETag returns the strong ETag of the gcr derived from its checksum.
+func (gcr *goproxyCacheReader) ETag() string {
+	return `"` + hex.EncodeToString(gcr.checksum) + `"`
+}
+
+// serveGoproxy serves the req through the `servedGoproxy` as the leader of the
+// fetches it starts, whose waiters share its error if it fails. It is tracked
+// as an in-flight operation.
+func serveGoproxy(rw http.ResponseWriter, req *http.Request) {
+	ctx, span := base.Tracer.Start(
+		req.Context(),
+		"serveGoproxy",
+		trace.WithAttributes(
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	ctx, done := trackInFlightOperation(ctx, "fetch")
+	defer done()
+
+	// The requests that are not for the cached module files (e.g. the
+	// "list" files) always fetch, while the others only do on cache
+	// misses (see the `startGoproxyFetch`).
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if _, _, fileKind := parseGoproxyRequestName(name); fileKind != "" &&
+		fileKind != "sumdb" &&
+		!validGoproxyCacheName(name) {
+		accessLogEntryFromContext(ctx).startFetch()
+	}
+
+	ctx, endFetches := withGoproxyFetchLeader(ctx)
+	gfrw := &goproxyFetchResponseWriter{
+		ResponseWriter: rw,
+		gfl:            goproxyFetchLeaderFromContext(ctx),
+	}
+	defer func() {
+		endFetches(gfrw.fetchError())
+	}()
+
+	servedGoproxy.Load().ServeHTTP(gfrw, req.WithContext(ctx))
+}
+
+// fetchGoproxy fetches the name with the method through the `hhGoproxy` and
+// returns the recorded response.
+func fetchGoproxy(
+	ctx context.Context,
+	method string,
+	name string,
+) *goproxyResponseRecorder {
+	req, _ := http.NewRequestWithContext(ctx, method, "/", nil)
+	req.URL.Path = "/" + name
+
+	grr := &goproxyResponseRecorder{header: http.Header{}}
+	serveGoproxy(grr, req)
+	if grr.status == 0 {
+		grr.status = http.StatusOK
+	}
+
+	return grr
+}
+
+// goproxyResponseRecorder implements the `http.ResponseWriter` to record the
+// responses of the `hhGoproxy`.
+type goproxyResponseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header implements the `http.ResponseWriter`.
+func (grr *goproxyResponseRecorder) Header() http.Header {
+	return grr.header
+}
+
+// WriteHeader implements the `http.ResponseWriter`.
+func (grr *goproxyResponseRecorder) WriteHeader(status int) {
+	if grr.status == 0 {
+		grr.status = status
+	}
+}
+
+// Write implements the `http.ResponseWriter`.
+func (grr *goproxyResponseRecorder) Write(b []byte) (int, error) {
+	grr.WriteHeader(http.StatusOK)
+	return grr.body.Write(b)
 }
 
 // validGoproxyCacheName reports whether the name is a valid Goproxy cache name.
 func validGoproxyCacheName(name string) bool {
+	_, _, _, ok := parseGoproxyCacheName(name)
+	return ok
+}
+
+// parseGoproxyRequestName parses the name of a request to the Go module proxy
+// and returns the module path, module version and file kind (e.g. "zip",
+// "list" or "sumdb") in it. They are empty if not found.
+func parseGoproxyRequestName(name string) (
+	modulePath string,
+	moduleVersion string,
+	fileKind string,
+) {
+	var escapedModulePath, escapedModuleVersion string
+	if strings.HasPrefix(name, "sumdb/") {
+		fileKind = "sumdb"
+	} else if emp, rest, ok := strings.Cut(name, "/@v/"); ok {
+		escapedModulePath = emp
+		if rest == "list" {
+			fileKind = "list"
+		} else if ext := path.Ext(rest); ext != "" {
+			escapedModuleVersion = strings.TrimSuffix(rest, ext)
+			fileKind = strings.TrimPrefix(ext, ".")
+		}
+	} else if emp, ok := strings.CutSuffix(name, "/@latest"); ok {
+		escapedModulePath = emp
+		fileKind = "latest"
+	}
+
+	modulePath, _ = module.UnescapePath(escapedModulePath)
+	moduleVersion, _ = module.UnescapeVersion(escapedModuleVersion)
+
+	return modulePath, moduleVersion, fileKind
+}
+
+// parseGoproxyCacheName parses the name as a Goproxy cache name and returns
+// the module path, module version and name extension in it. The ok reports
+// whether the name is a valid Goproxy cache name.
+func parseGoproxyCacheName(name string) (
+	modulePath string,
+	moduleVersion string,
+	nameExt string,
+	ok bool,
+) {
 	escapedModulePath, _, found := strings.Cut(name, "/@v/")
 	if !found {
-		return false
+		return "", "", "", false
 	}
 
-	if _, err := module.UnescapePath(escapedModulePath); err != nil {
-		return false
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return "", "", "", false
 	}
 
 	nameBase := path.Base(name)
-	nameExt := path.Ext(nameBase)
+	nameExt = path.Ext(nameBase)
 	switch nameExt {
 	case ".info", ".mod", ".zip":
 	default:
-		return false
+		return "", "", "", false
 	}
 
 	escapedModuleVersion := strings.TrimSuffix(nameBase, nameExt)
-	moduleVersion, err := module.UnescapeVersion(escapedModuleVersion)
-	if err != nil {
-		return false
+	moduleVersion, err = module.UnescapeVersion(escapedModuleVersion)
+	if err != nil || !semver.IsValid(moduleVersion) {
+		return "", "", "", false
 	}
 
-	return semver.IsValid(moduleVersion)
+	return modulePath, moduleVersion, nameExt, true
 }
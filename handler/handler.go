@@ -1,15 +1,10 @@
 package handler
 
 import (
-	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"net/http"
-	"net/url"
-	"os"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -17,28 +12,10 @@ import (
 	"github.com/air-gases/cacheman"
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy.cn/base"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/robfig/cron/v3"
 )
 
 var (
-	// qiniuViper is used to get the configuration items of the Qiniu Cloud.
-	qiniuViper = base.Viper.Sub("qiniu")
-
-	// qiniuKodoBucketName is the bucket name for the Qiniu Cloud Kodo.
-	qiniuKodoBucketName = qiniuViper.GetString("kodo_bucket_name")
-
-	// qiniuKodoMultipartUploadPartSize is the multipart upload part size
-	// for the Qiniu Cloud Kodo.
-	qiniuKodoMultipartUploadPartSize = qiniuViper.GetInt64("kodo_multipart_upload_part_size")
-
-	// qiniuKodoClient is the client for the Qiniu Cloud Kodo.
-	qiniuKodoClient *minio.Client
-
-	// qiniuKodoCore is the core for the Qiniu Cloud Kodo.
-	qiniuKodoCore *minio.Core
-
 	// getHeadMethods is an array contains the GET and HEAD methods.
 	getHeadMethods = []string{http.MethodGet, http.MethodHead}
 
@@ -58,69 +35,47 @@ var (
 
 	// moduleVersionCount is the module version count.
 	moduleVersionCount int
-)
 
-func init() {
-	qiniuKodoEndpoint, err := url.Parse(
-		qiniuViper.GetString("kodo_endpoint"),
-	)
-	if err != nil {
-		base.Logger.Fatal().Err(err).
-			Msg("failed to parse qiniu kodo endpoint")
-	}
+	// startFuncs is the functions run by the `Start`.
+	startFuncs []func()
 
-	qiniuKodoClientOptions := &minio.Options{
-		Creds: credentials.NewStaticV4(
-			qiniuViper.GetString("access_key"),
-			qiniuViper.GetString("secret_key"),
-			"",
-		),
-		Secure: qiniuKodoEndpoint.Scheme == "https",
-	}
-
-	if qiniuViper.GetBool("kodo_force_path_style") {
-		qiniuKodoClientOptions.BucketLookup = minio.BucketLookupPath
-	} else {
-		qiniuKodoClientOptions.BucketLookup = minio.BucketLookupDNS
-	}
+	// cleanupFuncs is the functions run by the `Cleanup`.
+	cleanupFuncs []func()
+)
 
-	qiniuKodoEndpoint.Scheme = ""
-	qiniuKodoClient, err = minio.New(
-		strings.TrimPrefix(qiniuKodoEndpoint.String(), "//"),
-		qiniuKodoClientOptions,
-	)
-	if err != nil {
+func init() {
+	var err error
+	if objectStorage, err = newStorage(); err != nil {
 		base.Logger.Fatal().Err(err).
-			Msg("failed to create qiniu kodo client")
+			Msg("failed to create storage")
 	}
 
-	qiniuKodoCore = &minio.Core{
-		Client: qiniuKodoClient,
-	}
-
-	if err := updateModuleVersionsCount(); err != nil {
-		base.Logger.Fatal().Err(err).
-			Msg("failed to initialize module version count")
-	}
+	onStart(func() {
+		if err := updateModuleVersionsCount(); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to initialize module version count")
+		}
 
-	if _, err := base.Cron.AddJob(
-		"* * * * *", // Every minute
-		cron.NewChain(
-			cron.SkipIfStillRunning(cron.DiscardLogger),
-		).Then(cron.FuncJob(func() {
-			err := updateModuleVersionsCount()
-			if err == nil {
-				return
-			}
-
-			base.Logger.Error().Err(err).
-				Msg("failed to update module version count")
-		})),
-	); err != nil {
-		base.Logger.Fatal().Err(err).
-			Msg("failed to add module version count update cron " +
-				"job")
-	}
+		if _, err := base.Cron.AddJob(
+			"* * * * *", // Every minute
+			cron.NewChain(
+				cron.SkipIfStillRunning(cron.DiscardLogger),
+			).Then(cron.FuncJob(func() {
+				err := updateModuleVersionsCount()
+				if err == nil {
+					return
+				}
+
+				base.Logger.Error().Err(err).
+					Msg("failed to update module version " +
+						"count")
+			})),
+		); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to add module version count " +
+					"update cron job")
+		}
+	})
 
 	base.Air.FILE("/robots.txt", "robots.txt")
 	base.Air.FILE("/favicon.ico", "favicon.ico", hourlyCachemanGas)
@@ -135,6 +90,35 @@ func init() {
 	base.Air.BATCH(getHeadMethods, "/", hIndexPage)
 }
 
+// Start starts the background work of the handlers (e.g. the cron jobs). It is
+// only needed to serve requests, so the one-off commands never call it.
+func Start() {
+	base.Start()
+	for _, f := range startFuncs {
+		f()
+	}
+}
+
+// onStart registers the f to be run by the `Start`.
+func onStart(f func()) {
+	startFuncs = append(startFuncs, f)
+}
+
+// Cleanup removes what the handlers have left behind (e.g. the temporary
+// files). It must be called before the process exits, whether it served
+// requests or ran a one-off command, and is safe to be called more than once.
+func Cleanup() {
+	for _, f := range cleanupFuncs {
+		f()
+	}
+}
+
+// onCleanup registers the f to be run by the `Cleanup`. The f must be safe to
+// be called more than once and concurrently.
+func onCleanup(f func()) {
+	cleanupFuncs = append(cleanupFuncs, f)
+}
+
 // NotFound returns not found error.
 func NotFound(req *air.Request, res *air.Response) error {
 	res.Status = http.StatusNotFound
@@ -181,203 +165,21 @@ func hIndexPage(req *air.Request, res *air.Response) error {
 
 // updateModuleVersionsCount updates the `moduleVersionCount`.
 func updateModuleVersionsCount() error {
-	var statSummary struct {
-		ModuleVersionCount int `json:"module_version_count"`
-	}
-
-	if err := retryQiniuKodoDo(base.Context, func(
-		ctx context.Context,
-	) error {
-		object, err := qiniuKodoClient.GetObject(
-			ctx,
-			qiniuKodoBucketName,
-			"stats/summary",
-			minio.GetObjectOptions{},
-		)
-		if err != nil {
-			return err
-		}
-		defer object.Close()
-
-		return json.NewDecoder(object).Decode(&statSummary)
-	}); err != nil {
+	var summary statSummary
+	if err := getJSONObject(
+		base.Context,
+		"stats/summary",
+		&summary,
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 
-	moduleVersionCount = statSummary.ModuleVersionCount
-
-	return nil
-}
-
-// qiniuKodoUpload uploads the content with the name to the Qiniu Cloud Kodo.
-func qiniuKodoUpload(
-	ctx context.Context,
-	name string,
-	content io.ReadSeeker,
-) (err error) {
-	var contentType string
-	switch path.Base(name) {
-	case "@latest":
-		contentType = "application/json; charset=utf-8"
-	case "list":
-		contentType = "text/plain; charset=utf-8"
-	default:
-		switch path.Ext(name) {
-		case ".info":
-			contentType = "application/json; charset=utf-8"
-		case ".mod":
-			contentType = "text/plain; charset=utf-8"
-		case ".zip":
-			contentType = "application/zip"
-		}
-	}
+	moduleVersionCount = summary.ModuleVersionCount
 
-	var size int64
-	if f, ok := content.(*os.File); ok {
-		fi, err := f.Stat()
-		if err != nil {
-			return err
-		}
-
-		size = fi.Size()
-	} else if size, err = content.Seek(0, io.SeekEnd); err != nil {
-		return err
-	} else if _, err := content.Seek(0, io.SeekStart); err != nil {
-		return err
-	}
-
-	if size <= qiniuKodoMultipartUploadPartSize {
-		content := content
-		if ra, ok := content.(io.ReaderAt); ok {
-			content = io.NewSectionReader(ra, 0, size)
-		} else if _, err := content.Seek(0, io.SeekStart); err != nil {
-			return err
-		}
-
-		return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-			_, err := qiniuKodoCore.PutObject(
-				ctx,
-				qiniuKodoBucketName,
-				name,
-				content,
-				size,
-				"",
-				"",
-				minio.PutObjectOptions{
-					ContentType: contentType,
-				},
-			)
-			return err
-		})
-	}
+	now := time.Now()
+	moduleVersionCountUpdatedAt.Store(&now)
 
-	var uploadID string
-	if err := retryQiniuKodoDo(ctx, func(ctx context.Context) (err error) {
-		uploadID, err = qiniuKodoCore.NewMultipartUpload(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			minio.PutObjectOptions{
-				ContentType: contentType,
-			},
-		)
-		return err
-	}); err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-				return qiniuKodoCore.AbortMultipartUpload(
-					ctx,
-					qiniuKodoBucketName,
-					name,
-					uploadID,
-				)
-			})
-		}
-	}()
-
-	var completeParts []minio.CompletePart
-	for offset := int64(0); offset < size; {
-		partSize := min(qiniuKodoMultipartUploadPartSize, size-offset)
-
-		var part minio.ObjectPart
-		if err := retryQiniuKodoDo(ctx, func(
-			ctx context.Context,
-		) (err error) {
-			content := content
-			if ra, ok := content.(io.ReaderAt); ok {
-				content = io.NewSectionReader(
-					ra,
-					offset,
-					partSize,
-				)
-			} else if _, err := content.Seek(
-				offset,
-				io.SeekStart,
-			); err != nil {
-				return err
-			}
-
-			part, err = qiniuKodoCore.PutObjectPart(
-				ctx,
-				qiniuKodoBucketName,
-				name,
-				uploadID,
-				len(completeParts)+1,
-				io.LimitReader(content, partSize),
-				partSize,
-				minio.PutObjectPartOptions{},
-			)
-
-			return err
-		}); err != nil {
-			return err
-		}
-
-		completeParts = append(completeParts, minio.CompletePart{
-			PartNumber: part.PartNumber,
-			ETag:       part.ETag,
-		})
-
-		offset += part.Size
-	}
-
-	return retryQiniuKodoDo(ctx, func(ctx context.Context) error {
-		_, err := qiniuKodoCore.CompleteMultipartUpload(
-			ctx,
-			qiniuKodoBucketName,
-			name,
-			uploadID,
-			completeParts,
-			minio.PutObjectOptions{
-				ContentType: contentType,
-			},
-		)
-		return err
-	})
-}
-
-// retryQiniuKodoDo retries a Qiniu Cloud Kodo operation in case of some special
-// errors.
-func retryQiniuKodoDo(
-	ctx context.Context,
-	f func(ctx context.Context) error,
-) error {
-	return base.RetryN(ctx, f, func(err error) bool {
-		switch minio.ToErrorResponse(err).StatusCode {
-		case 573, 579, 599:
-			return true
-		}
-
-		return false
-	}, 100*time.Millisecond, 10)
-}
-
-// isNotFoundMinIOError reports whether the err is MinIO not found error.
-func isNotFoundMinIOError(err error) bool {
-	return minio.ToErrorResponse(err).StatusCode == http.StatusNotFound
+	return nil
 }
 
 // thousandsCommaSeperated returns a thousands comma separated string for the n.
@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+var (
+	// healthCheckTimeout is the timeout of each readiness check.
+	healthCheckTimeout = newReloadable(time.Duration(0))
+
+	// healthModuleVersionCountMaxAge is the maximum age of the last
+	// successful update of the `moduleVersionCount` for the process to be
+	// ready.
+	healthModuleVersionCountMaxAge = newReloadable(time.Duration(0))
+
+	// moduleVersionCountUpdatedAt is the time of the last successful
+	// update of the `moduleVersionCount`.
+	moduleVersionCountUpdatedAt atomic.Pointer[time.Time]
+)
+
+// errHealthDegraded is wrapped by the errors of the readiness checks that
+// degrade the process without making it unready.
+var errHealthDegraded = errors.New("degraded")
+
+func init() {
+	loadHealthConfig(base.Viper)()
+	base.OnConfigReload([]string{
+		"health.check_timeout",
+		"health.module_version_count_max_age",
+	}, func(v *viper.Viper) (func(), error) {
+		return loadHealthConfig(v), nil
+	})
+
+	base.Air.BATCH(getHeadMethods, "/healthz", hHealthz)
+	base.Air.BATCH(getHeadMethods, "/readyz", hReadyz)
+}
+
+// loadHealthConfig loads the configuration items of the health checks from the
+// v and returns a function that applies them.
+func loadHealthConfig(v *viper.Viper) func() {
+	checkTimeout := v.GetDuration("health.check_timeout")
+	if checkTimeout <= 0 {
+		checkTimeout = 5 * time.Second
+	}
+
+	moduleVersionCountMaxAge := v.GetDuration(
+		"health.module_version_count_max_age",
+	)
+	if moduleVersionCountMaxAge <= 0 {
+		moduleVersionCountMaxAge = 5 * time.Minute
+	}
+
+	return func() {
+		healthCheckTimeout.Store(checkTimeout)
+		healthModuleVersionCountMaxAge.Store(moduleVersionCountMaxAge)
+	}
+}
+
+// healthReport is the report of the health checks.
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// healthCheck is the result of a single health check.
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// hHealthz handles requests to check whether the process is alive.
+func hHealthz(req *air.Request, res *air.Response) error {
+	return writeHealthReport(res, healthReport{Status: "ok"})
+}
+
+// hReadyz handles requests to check whether the process is ready to serve.
+func hReadyz(req *air.Request, res *air.Response) error {
+	hr := healthReport{
+		Status: "ok",
+		Checks: map[string]healthCheck{},
+	}
+
+	for name, check := range map[string]func(context.Context) error{
+		"draining":             checkDraining,
+		"storage":              checkStorage,
+		"storage_breaker":      checkStorageBreaker,
+		"go_bin":               checkGoBin,
+		"goproxy_upstreams":    checkGoproxyUpstreams,
+		"module_version_count": checkModuleVersionCount,
+	} {
+		ctx, cancel := context.WithTimeout(
+			req.Context,
+			healthCheckTimeout.Load(),
+		)
+		err := check(ctx)
+		cancel()
+
+		if errors.Is(err, errHealthDegraded) {
+			if hr.Status == "ok" {
+				hr.Status = "degraded"
+			}
+
+			hr.Checks[name] = healthCheck{
+				Status: "degraded",
+				Error:  err.Error(),
+			}
+		} else if err != nil {
+			hr.Status = "fail"
+			hr.Checks[name] = healthCheck{
+				Status: "fail",
+				Error:  err.Error(),
+			}
+		} else {
+			hr.Checks[name] = healthCheck{Status: "ok"}
+		}
+	}
+
+	if hr.Status == "fail" {
+		res.Status = http.StatusServiceUnavailable
+	}
+
+	return writeHealthReport(res, hr)
+}
+
+// writeHealthReport writes the hr to the res.
+func writeHealthReport(res *air.Response, hr healthReport) error {
+	res.Header.Set("Cache-Control", "no-store")
+	return res.WriteJSON(hr)
+}
+
+// checkDraining checks whether the process is not draining.
+func checkDraining(context.Context) error {
+	if draining.Load() {
+		return errors.New("draining")
+	}
+
+	return nil
+}
+
+// checkStorage checks whether the `objectStorage` is reachable. It is only
+// degraded while the `objectStorageBreaker` is open, as the requests are still
+// served without the `objectStorage`.
+func checkStorage(ctx context.Context) error {
+	_, err := objectStorage.Stat(ctx, "stats/summary")
+	if errors.Is(err, errStorageCircuitOpen) {
+		return fmt.Errorf("%w: %w", errHealthDegraded, err)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// checkStorageBreaker checks whether the `objectStorageBreaker` is closed.
+func checkStorageBreaker(context.Context) error {
+	if objectStorageBreaker == nil {
+		return nil
+	}
+
+	state := objectStorageBreaker.State()
+	if state != storageBreakerClosed {
+		return fmt.Errorf(
+			"%w: storage circuit breaker is %s",
+			errHealthDegraded,
+			state,
+		)
+	}
+
+	return nil
+}
+
+// checkGoBin checks whether the Go binary targeted by the
+// `hhGoproxy.GoBinName` is executable.
+func checkGoBin(context.Context) error {
+	_, err := exec.LookPath(hhGoproxy.GoBinName)
+	return err
+}
+
+// checkGoproxyUpstreams checks whether all upstreams returned by the
+// `currentGoproxyUpstreams` are healthy. It is only degraded otherwise, as the
+// requests may still fall back to the other upstreams.
+func checkGoproxyUpstreams(context.Context) error {
+	var unhealthy []string
+	for _, gu := range currentGoproxyUpstreams() {
+		if !gu.healthy() {
+			unhealthy = append(unhealthy, gu.redactedURL())
+		}
+	}
+
+	if len(unhealthy) > 0 {
+		return fmt.Errorf(
+			"%w: unhealthy goproxy upstreams: %s",
+			errHealthDegraded,
+			strings.Join(unhealthy, ", "),
+		)
+	}
+
+	return nil
+}
+
+// checkModuleVersionCount checks whether the `moduleVersionCount` has been
+// updated recently.
+func checkModuleVersionCount(context.Context) error {
+	updatedAt := moduleVersionCountUpdatedAt.Load()
+	if updatedAt == nil {
+		return errors.New("never updated")
+	}
+
+	age := time.Since(*updatedAt)
+	if age > healthModuleVersionCountMaxAge.Load() {
+		return fmt.Errorf("last updated %s ago", age.Round(time.Second))
+	}
+
+	return nil
+}
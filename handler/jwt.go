@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// jwtSignatureAlgorithms is the signature algorithms of the JWTs accepted by
+// the `jwtVerifier`.
+var jwtSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256,
+	jose.RS384,
+	jose.RS512,
+	jose.PS256,
+	jose.PS384,
+	jose.PS512,
+	jose.ES256,
+	jose.ES384,
+	jose.ES512,
+	jose.EdDSA,
+}
+
+// jwtVerifier is a verifier of the JWTs issued by an OIDC provider.
+type jwtVerifier struct {
+	issuer       string
+	audience     string
+	jwksURL      string
+	subjectClaim string
+	httpClient   *http.Client
+
+	keysMutex     sync.RWMutex
+	keys          jose.JSONWebKeySet
+	keysUpdatedAt time.Time
+
+	// keysUpdateMutex serializes the updates of the keys, so that a burst
+	// of tokens with an unknown key ID does not fetch the JSON Web Key
+	// Set more than once.
+	keysUpdateMutex sync.Mutex
+}
+
+// newJWTVerifier returns a new instance of the `jwtVerifier`. If the jwksURL is
+// empty, it will be discovered from the issuer.
+func newJWTVerifier(
+	issuer string,
+	audience string,
+	jwksURL string,
+	subjectClaim string,
+) *jwtVerifier {
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+
+	return &jwtVerifier{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		audience:     audience,
+		jwksURL:      jwksURL,
+		subjectClaim: subjectClaim,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// verify verifies the token and returns its subject.
+func (jv *jwtVerifier) verify(
+	ctx context.Context,
+	token string,
+) (string, error) {
+	t, err := jwt.ParseSigned(token, jwtSignatureAlgorithms)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := jv.key(ctx, t.Headers[0].KeyID)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		claims       jwt.Claims
+		customClaims map[string]any
+	)
+	if err := t.Claims(key, &claims, &customClaims); err != nil {
+		return "", err
+	}
+
+	if claims.Expiry == nil {
+		return "", errors.New("missing jwt expiry")
+	}
+
+	expected := jwt.Expected{}
+	if jv.audience != "" {
+		expected.AnyAudience = jwt.Audience{jv.audience}
+	}
+
+	if err := claims.ValidateWithLeeway(
+		expected,
+		jwt.DefaultLeeway,
+	); err != nil {
+		return "", err
+	}
+
+	if jv.issuer != "" &&
+		strings.TrimSuffix(claims.Issuer, "/") != jv.issuer {
+		return "", jwt.ErrInvalidIssuer
+	}
+
+	subject, _ := customClaims[jv.subjectClaim].(string)
+	if subject == "" {
+		return "", errors.New("missing jwt subject")
+	}
+
+	return subject, nil
+}
+
+// key returns the public key targeted by the kid. The JSON Web Key Set is
+// refreshed at most once a minute when the kid is unknown, and at least once an
+// hour.
+func (jv *jwtVerifier) key(
+	ctx context.Context,
+	kid string,
+) (jose.JSONWebKey, error) {
+	key, ok, updatedAt := jv.cachedKey(kid)
+	if ok && time.Since(updatedAt) < time.Hour {
+		return key, nil
+	}
+
+	if time.Since(updatedAt) >= time.Minute {
+		if err := jv.updateKeys(ctx, updatedAt); err != nil {
+			if ok {
+				return key, nil
+			}
+
+			return jose.JSONWebKey{}, err
+		}
+
+		key, ok, _ = jv.cachedKey(kid)
+	}
+
+	if !ok {
+		return jose.JSONWebKey{}, fmt.Errorf(
+			"unknown jwt key id: %q",
+			kid,
+		)
+	}
+
+	return key, nil
+}
+
+// cachedKey returns the public key targeted by the kid in the keys of the jv,
+// and when they were updated.
+func (jv *jwtVerifier) cachedKey(
+	kid string,
+) (jose.JSONWebKey, bool, time.Time) {
+	jv.keysMutex.RLock()
+	defer jv.keysMutex.RUnlock()
+	for _, key := range jv.keys.Key(kid) {
+		if key.Use == "" || key.Use == "sig" {
+			return key, true, jv.keysUpdatedAt
+		}
+	}
+
+	return jose.JSONWebKey{}, false, jv.keysUpdatedAt
+}
+
+// updateKeys updates the keys of the jv from its JSON Web Key Set, unless they
+// have been updated since the updatedAt. The keys remain usable during the
+// update.
+func (jv *jwtVerifier) updateKeys(
+	ctx context.Context,
+	updatedAt time.Time,
+) error {
+	jv.keysUpdateMutex.Lock()
+	defer jv.keysUpdateMutex.Unlock()
+
+	jv.keysMutex.RLock()
+	updated := jv.keysUpdatedAt.After(updatedAt)
+	jv.keysMutex.RUnlock()
+	if updated {
+		return nil
+	}
+
+	jwksURL := jv.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := jv.getJSON(
+			ctx,
+			jv.issuer+"/.well-known/openid-configuration",
+			&discovery,
+		); err != nil {
+			return err
+		}
+
+		jwksURL = discovery.JWKSURI
+	}
+
+	// Keys that cannot be parsed (e.g. of unsupported types) are skipped
+	// instead of failing the whole set.
+	var rawJWKS struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := jv.getJSON(ctx, jwksURL, &rawJWKS); err != nil {
+		return err
+	}
+
+	var jwks jose.JSONWebKeySet
+	for _, rawKey := range rawJWKS.Keys {
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(rawKey); err != nil ||
+			!key.IsPublic() {
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, key)
+	}
+
+	jv.keysMutex.Lock()
+	jv.keys = jwks
+	jv.keysUpdatedAt = time.Now()
+	jv.keysMutex.Unlock()
+
+	return nil
+}
+
+// getJSON gets the JSON value from the url and decodes it into the v.
+func (jv *jwtVerifier) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := jv.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestJWTVerifierVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jwksRequests atomic.Int64
+	s := httptest.NewServer(http.HandlerFunc(func(
+		rw http.ResponseWriter,
+		req *http.Request,
+	) {
+		jwksRequests.Add(1)
+		json.NewEncoder(rw).Encode(map[string]any{
+			"keys": []any{
+				jose.JSONWebKey{
+					Key:   rsaKey.Public(),
+					KeyID: "rsa",
+					Use:   "sig",
+				},
+				jose.JSONWebKey{
+					Key:   ecKey.Public(),
+					KeyID: "ec",
+				},
+				map[string]string{
+					"kty": "unsupported",
+					"kid": "unsupported",
+				},
+			},
+		})
+	}))
+	defer s.Close()
+
+	sign := func(
+		alg jose.SignatureAlgorithm,
+		key any,
+		kid string,
+		claims map[string]any,
+	) string {
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: alg, Key: key},
+			(&jose.SignerOptions{}).WithHeader("kid", kid),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := jwt.Signed(signer).Claims(claims).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	now := time.Now()
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"iss": "https://issuer.example.com/",
+			"aud": []string{"other", "goproxy"},
+			"sub": "alice",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+	}
+
+	withClaim := func(key string, value any) map[string]any {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+
+		return claims
+	}
+
+	validToken := sign(jose.ES256, ecKey, "ec", validClaims())
+	validParts := strings.Split(validToken, ".")
+	otherParts := strings.Split(
+		sign(jose.ES256, ecKey, "ec", withClaim("sub", "mallory")),
+		".",
+	)
+
+	for _, tt := range []struct {
+		name        string
+		token       string
+		wantSubject string
+	}{
+		{
+			name:        "ES256",
+			token:       validToken,
+			wantSubject: "alice",
+		},
+		{
+			name: "RS256",
+			token: sign(
+				jose.RS256,
+				rsaKey,
+				"rsa",
+				validClaims(),
+			),
+			wantSubject: "alice",
+		},
+		{
+			name: "PS384",
+			token: sign(
+				jose.PS384,
+				rsaKey,
+				"rsa",
+				validClaims(),
+			),
+			wantSubject: "alice",
+		},
+		{
+			name: "SingleAudience",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("aud", "goproxy"),
+			),
+			wantSubject: "alice",
+		},
+		{
+			name: "WrongKey",
+			token: sign(
+				jose.ES256,
+				otherECKey,
+				"ec",
+				validClaims(),
+			),
+		},
+		{
+			name: "MismatchedKeyType",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"rsa",
+				validClaims(),
+			),
+		},
+		{
+			name: "UnknownKeyID",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"unknown",
+				validClaims(),
+			),
+		},
+		{
+			name: "TamperedPayload",
+			token: strings.Join([]string{
+				validParts[0],
+				otherParts[1],
+				validParts[2],
+			}, "."),
+		},
+		{
+			name: "TruncatedSignature",
+			token: strings.Join([]string{
+				validParts[0],
+				validParts[1],
+				base64.RawURLEncoding.EncodeToString([]byte{1}),
+			}, "."),
+		},
+		{
+			name: "NoneAlgorithm",
+			token: strings.Join([]string{
+				base64.RawURLEncoding.EncodeToString(
+					[]byte(`{"alg":"none","kid":"ec"}`),
+				),
+				validParts[1],
+				"",
+			}, "."),
+		},
+		{
+			name: "HS256",
+			token: sign(
+				jose.HS256,
+				[]byte("0123456789abcdef0123456789abcdef"),
+				"ec",
+				validClaims(),
+			),
+		},
+		{
+			name: "Expired",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("exp", now.Add(-time.Hour).Unix()),
+			),
+		},
+		{
+			name: "MissingExpiry",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("exp", nil),
+			),
+		},
+		{
+			name: "NotYetValid",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("nbf", now.Add(time.Hour).Unix()),
+			),
+		},
+		{
+			name: "WrongIssuer",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("iss", "https://evil.example.com"),
+			),
+		},
+		{
+			name: "WrongAudience",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("aud", "other"),
+			),
+		},
+		{
+			name: "MissingSubject",
+			token: sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("sub", nil),
+			),
+		},
+		{
+			name:  "Malformed",
+			token: "not-a-jwt",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			jv := newJWTVerifier(
+				"https://issuer.example.com",
+				"goproxy",
+				s.URL,
+				"",
+			)
+
+			subject, err := jv.verify(
+				context.Background(),
+				tt.token,
+			)
+			if tt.wantSubject == "" {
+				if err == nil {
+					t.Fatalf(
+						"got subject %q, want error",
+						subject,
+					)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %q", err)
+			}
+
+			if subject != tt.wantSubject {
+				t.Errorf(
+					"got subject %q, want %q",
+					subject,
+					tt.wantSubject,
+				)
+			}
+		})
+	}
+
+	t.Run("SubjectClaim", func(t *testing.T) {
+		jv := newJWTVerifier(
+			"https://issuer.example.com",
+			"",
+			s.URL,
+			"email",
+		)
+
+		subject, err := jv.verify(
+			context.Background(),
+			sign(
+				jose.ES256,
+				ecKey,
+				"ec",
+				withClaim("email", "alice@example.com"),
+			),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error %q", err)
+		}
+
+		if want := "alice@example.com"; subject != want {
+			t.Errorf("got subject %q, want %q", subject, want)
+		}
+	})
+
+	t.Run("KeysRefreshedAtMostOncePerMinute", func(t *testing.T) {
+		jv := newJWTVerifier(
+			"https://issuer.example.com",
+			"goproxy",
+			s.URL,
+			"",
+		)
+
+		jwksRequests.Store(0)
+		for _, kid := range []string{"ec", "unknown", "unknown"} {
+			jv.verify(context.Background(), sign(
+				jose.ES256,
+				ecKey,
+				kid,
+				validClaims(),
+			))
+		}
+
+		if got := jwksRequests.Load(); got != 1 {
+			t.Errorf("got %d JWKS requests, want 1", got)
+		}
+	})
+}
@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"container/list"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// goproxyLocalCache is the local disk cache tier in front of the
+	// `objectStorage` for the `goproxyCacher`. It is nil if disabled.
+	goproxyLocalCache *localCache
+
+	// goproxyNegativeCache is the negative cache of the `goproxyCacher`.
+	// It is nil if disabled.
+	goproxyNegativeCache *negativeCache
+)
+
+// localCacheDirName is the name of the directory of the `localCache` under the
+// configured one, which may be shared with others (e.g. "/var/cache"), so that
+// only the files created by the `localCache` are ever removed.
+const localCacheDirName = "goproxy.cn-localcache"
+
+func init() {
+	// The one-off commands never use the local cache, as its entries
+	// are only indexed in the memory of the serving process.
+	if dir := goproxyViper.GetString("local_cache_dir"); dir != "" {
+		onStart(func() {
+			var err error
+			if goproxyLocalCache, err = newLocalCache(
+				filepath.Join(dir, localCacheDirName),
+				goproxyViper.GetInt64("local_cache_max_bytes"),
+				goproxyViper.GetInt64(
+					"local_cache_max_file_bytes",
+				),
+				goproxyViper.GetDuration("local_cache_ttl"),
+			); err != nil {
+				base.Logger.Fatal().Err(err).
+					Msg("failed to create goproxy local " +
+						"cache")
+			}
+		})
+	}
+
+	if ttl := goproxyViper.GetDuration("negative_cache_ttl"); ttl > 0 {
+		goproxyNegativeCache = newNegativeCache(ttl, 100_000)
+	}
+}
+
+// localCache is a bounded LRU cache of the `objectStorage` objects on the
+// local disk. Its entries are only indexed in memory, so its own directory is
+// emptied when it is created.
+type localCache struct {
+	dir          string
+	maxBytes     int64
+	maxFileBytes int64
+	ttl          time.Duration
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// localCacheEntry is an entry of the `localCache`.
+type localCacheEntry struct {
+	name        string
+	filename    string
+	objectInfo  storageObjectInfo
+	validatedAt time.Time
+}
+
+// newLocalCache returns a new instance of the `localCache`. Objects larger than
+// the maxFileBytes will not be cached. Objects that never change are
+// revalidated once they have been cached for the ttl (1 hour if not positive),
+// so that those purged from the `objectStorage` (e.g. by another replica) are
+// not served forever.
+func newLocalCache(
+	dir string,
+	maxBytes int64,
+	maxFileBytes int64,
+	ttl time.Duration,
+) (*localCache, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	if maxFileBytes <= 0 || maxFileBytes > maxBytes {
+		maxFileBytes = maxBytes
+	}
+
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	return &localCache{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		maxFileBytes: maxFileBytes,
+		ttl:          ttl,
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+	}, nil
+}
+
+// Get gets the object targeted by the name from the lc. Objects that may change
+// (e.g. the "list" and "@latest" files) and those validated longer than the
+// `lc.ttl` ago are revalidated against the ETag of the one in the
+// `objectStorage`, and served stale while the `objectStorageBreaker` is open.
+func (lc *localCache) Get(ctx context.Context, name string) (
+	io.ReadSeekCloser,
+	storageObjectInfo,
+	error,
+) {
+	var lce localCacheEntry
+
+	lc.mutex.Lock()
+	e, ok := lc.entries[name]
+	if ok {
+		lc.lru.MoveToFront(e)
+		lce = *e.Value.(*localCacheEntry)
+	}
+	lc.mutex.Unlock()
+
+	if !ok {
+		return nil, storageObjectInfo{}, fs.ErrNotExist
+	}
+
+	if !validGoproxyCacheName(name) ||
+		time.Since(lce.validatedAt) >= lc.ttl {
+		objectInfo, err := objectStorage.Stat(ctx, name)
+		switch {
+		case errors.Is(err, errStorageCircuitOpen):
+			// Served stale.
+		case err != nil:
+			if errors.Is(err, fs.ErrNotExist) {
+				lc.remove(name)
+			}
+
+			return nil, storageObjectInfo{}, err
+		case objectInfo.ETag != lce.objectInfo.ETag:
+			lc.remove(name)
+			return nil, storageObjectInfo{}, fs.ErrNotExist
+		default:
+			lc.validated(name)
+		}
+	}
+
+	f, err := os.Open(lce.filename)
+	if err != nil {
+		lc.remove(name)
+		return nil, storageObjectInfo{}, fs.ErrNotExist
+	}
+
+	return f, lce.objectInfo, nil
+}
+
+// Put puts the content of the object described by the objectInfo to the lc and
+// returns the local copy of it. The content is validated against the known
+// checksums of the objectInfo.
+func (lc *localCache) Put(
+	objectInfo storageObjectInfo,
+	content io.Reader,
+) (io.ReadSeekCloser, error) {
+	if objectInfo.Size > lc.maxFileBytes {
+		return nil, errors.New("too large local cache")
+	}
+
+	nameChecksum := sha256.Sum256([]byte(objectInfo.Name))
+	nameHex := hex.EncodeToString(nameChecksum[:])
+	filename := filepath.Join(lc.dir, nameHex[:2], nameHex)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o750); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), ".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	n, err := io.Copy(
+		io.MultiWriter(f, sha256Hash, md5Hash),
+		content,
+	)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if n != objectInfo.Size {
+		f.Close()
+		return nil, errors.New("mismatched local cache size")
+	}
+
+	if !objectInfo.matchChecksums(sha256Hash.Sum(nil), md5Hash.Sum(nil)) {
+		f.Close()
+		return nil, errors.New("mismatched local cache checksum")
+	}
+
+	if err := os.Rename(f.Name(), filename); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	if e, ok := lc.entries[objectInfo.Name]; ok {
+		lc.removeElement(e, false)
+	}
+
+	lc.entries[objectInfo.Name] = lc.lru.PushFront(&localCacheEntry{
+		name:        objectInfo.Name,
+		filename:    filename,
+		objectInfo:  objectInfo,
+		validatedAt: time.Now(),
+	})
+	lc.size += objectInfo.Size
+
+	for lc.size > lc.maxBytes {
+		lc.removeElement(lc.lru.Back(), true)
+	}
+
+	return f, nil
+}
+
+// validated marks the object targeted by the name in the lc as just validated.
+func (lc *localCache) validated(name string) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if e, ok := lc.entries[name]; ok {
+		e.Value.(*localCacheEntry).validatedAt = time.Now()
+	}
+}
+
+// remove removes the object targeted by the name from the lc.
+func (lc *localCache) remove(name string) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if e, ok := lc.entries[name]; ok {
+		lc.removeElement(e, true)
+	}
+}
+
+// removeElement removes the e from the lc. The local file of the e is also
+// removed if the removeFile is true.
+func (lc *localCache) removeElement(e *list.Element, removeFile bool) {
+	lce := lc.lru.Remove(e).(*localCacheEntry)
+	delete(lc.entries, lce.name)
+	lc.size -= lce.objectInfo.Size
+	if removeFile {
+		os.Remove(lce.filename)
+	}
+}
+
+// negativeCache is a bounded cache of the names known not to exist for a
+// period of time.
+type negativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mutex     sync.Mutex
+	expiresAt map[string]time.Time
+}
+
+// newNegativeCache returns a new instance of the `negativeCache`.
+func newNegativeCache(ttl time.Duration, maxEntries int) *negativeCache {
+	return &negativeCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		expiresAt:  map[string]time.Time{},
+	}
+}
+
+// Contains reports whether the name is known not to exist.
+func (nc *negativeCache) Contains(name string) bool {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	expiresAt, ok := nc.expiresAt[name]
+	if ok && time.Now().After(expiresAt) {
+		delete(nc.expiresAt, name)
+		return false
+	}
+
+	return ok
+}
+
+// Add adds the name to the nc.
+func (nc *negativeCache) Add(name string) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	now := time.Now()
+	if len(nc.expiresAt) >= nc.maxEntries {
+		for name, expiresAt := range nc.expiresAt {
+			if now.After(expiresAt) {
+				delete(nc.expiresAt, name)
+			}
+		}
+
+		if len(nc.expiresAt) >= nc.maxEntries {
+			clear(nc.expiresAt)
+		}
+	}
+
+	nc.expiresAt[name] = now.Add(nc.ttl)
+}
+
+// Remove removes the name from the nc.
+func (nc *negativeCache) Remove(name string) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	delete(nc.expiresAt, name)
+}
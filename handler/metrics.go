@@ -0,0 +1,375 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// metricsEnabled indicates whether the metrics endpoint is enabled.
+	metricsEnabled = base.Viper.GetBool("metrics.enabled")
+
+	// metricsAddress is the TCP address that the metrics endpoint listens
+	// on. If it is empty, the metrics endpoint is served by the `base.Air`.
+	metricsAddress = base.Viper.GetString("metrics.address")
+
+	// metricsRegistry is the registry of all metrics.
+	metricsRegistry = prometheus.NewRegistry()
+
+	// httpRequestsTotal is the counter of the HTTP requests.
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_http_requests_total",
+			Help: "Total number of HTTP requests.",
+		},
+		[]string{"route", "kind", "code"},
+	)
+
+	// httpRequestDuration is the histogram of the HTTP request durations.
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "goproxycn_http_request_duration_seconds",
+			Help: "Duration of HTTP requests in seconds.",
+			Buckets: []float64{
+				.005, .01, .025, .05, .1, .25, .5,
+				1, 2.5, 5, 10, 30, 60,
+			},
+		},
+		[]string{"route", "kind"},
+	)
+
+	// cacheLookupsTotal is the counter of the `goproxyCacher` lookups.
+	cacheLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_cache_lookups_total",
+			Help: "Total number of cache lookups by result.",
+		},
+		[]string{"result"},
+	)
+
+	// cacheServedBytesTotal is the counter of the bytes served from the
+	// `goproxyCacher`.
+	cacheServedBytesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "goproxycn_cache_served_bytes_total",
+			Help: "Total number of bytes served from the cache.",
+		},
+	)
+
+	// cacheScrubbedObjectsTotal is the counter of the cached module files
+	// verified by the scrubber.
+	cacheScrubbedObjectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_cache_scrubbed_objects_total",
+			Help: "Total number of cached module files verified " +
+				"by the scrubber by result.",
+		},
+		[]string{"result"},
+	)
+
+	// inFlightOperations is the gauge of the in-flight operations waited
+	// for by the `Drain`.
+	inFlightOperations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goproxycn_in_flight_operations",
+			Help: "Number of in-flight operations by kind.",
+		},
+		[]string{"kind"},
+	)
+
+	// goproxyFetchWaitsTotal is the counter of the waits for the fetches
+	// of the cached module files led by others.
+	goproxyFetchWaitsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_fetch_waits_total",
+			Help: "Total number of waits for fetches led by " +
+				"others by scope.",
+		},
+		[]string{"scope"},
+	)
+
+	// rateLimitedRequestsTotal is the counter of the requests refused by
+	// the rate limits.
+	rateLimitedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_rate_limited_requests_total",
+			Help: "Total number of requests refused by the rate " +
+				"limits by budget.",
+		},
+		[]string{"budget"},
+	)
+
+	// ttlCacheLookupsTotal is the counter of the `ttlCache` lookups.
+	ttlCacheLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_ttl_cache_lookups_total",
+			Help: "Total number of in-process TTL cache lookups " +
+				"by result.",
+		},
+		[]string{"cache", "result"},
+	)
+
+	// ttlCacheEvictionsTotal is the counter of the `ttlCache` evictions.
+	ttlCacheEvictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_ttl_cache_evictions_total",
+			Help: "Total number of in-process TTL cache entries " +
+				"evicted for capacity.",
+		},
+		[]string{"cache"},
+	)
+
+	// checksumDBVerificationsTotal is the counter of the checksum
+	// database verifications.
+	checksumDBVerificationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_checksum_db_verifications_total",
+			Help: "Total number of checksum database " +
+				"verifications by result.",
+		},
+		[]string{"result"},
+	)
+
+	// storageAttemptsTotal is the counter of the `objectStorage` operation
+	// attempts.
+	storageAttemptsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_storage_attempts_total",
+			Help: "Total number of storage operation attempts.",
+		},
+		[]string{"operation"},
+	)
+
+	// storageRetryableErrorsTotal is the counter of the retryable errors
+	// of the `objectStorage` operations that are retried.
+	storageRetryableErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_storage_retryable_errors_total",
+			Help: "Total number of retried storage errors by " +
+				"status code (or class without one).",
+		},
+		[]string{"operation", "code"},
+	)
+
+	// storageBreakerStateGauge is the gauge of the state of the
+	// `objectStorageBreaker`.
+	storageBreakerStateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "goproxycn_storage_breaker_state",
+			Help: "State of the storage circuit breaker, 1 for " +
+				"the current one.",
+		},
+		[]string{"state"},
+	)
+
+	// storageBreakerTransitionsTotal is the counter of the state
+	// transitions of the `objectStorageBreaker`.
+	storageBreakerTransitionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "goproxycn_storage_breaker_transitions_total",
+			Help: "Total number of storage circuit breaker " +
+				"transitions by target state.",
+		},
+		[]string{"state"},
+	)
+
+	// storageBreakerRejectionsTotal is the counter of the `objectStorage`
+	// operations rejected by the `objectStorageBreaker`.
+	storageBreakerRejectionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "goproxycn_storage_breaker_rejections_total",
+			Help: "Total number of storage operations rejected " +
+				"by the circuit breaker.",
+		},
+	)
+
+	// storageMultipartUploadPartDuration is the histogram of the
+	// `objectStorage` multipart upload part durations.
+	storageMultipartUploadPartDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "goproxycn_storage_multipart_upload_part_" +
+				"duration_seconds",
+			Help: "Duration of storage multipart upload parts in " +
+				"seconds.",
+			Buckets: prometheus.ExponentialBuckets(.1, 2, 12),
+		},
+	)
+
+	// goproxyUpstreamHealthyDesc is the description of the health states
+	// of the upstreams returned by the `currentGoproxyUpstreams`.
+	goproxyUpstreamHealthyDesc = prometheus.NewDesc(
+		"goproxycn_goproxy_upstream_healthy",
+		"Whether a goproxy upstream is healthy, 1 for healthy.",
+		[]string{"upstream"},
+		nil,
+	)
+)
+
+// goproxyUpstreamsCollector implements the `prometheus.Collector`. It collects
+// the health states of the upstreams returned by the `currentGoproxyUpstreams`
+// at scrape time, as they change with the time and the reloads.
+type goproxyUpstreamsCollector struct{}
+
+// Describe implements the `prometheus.Collector`.
+func (goproxyUpstreamsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- goproxyUpstreamHealthyDesc
+}
+
+// Collect implements the `prometheus.Collector`.
+func (goproxyUpstreamsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, gu := range currentGoproxyUpstreams() {
+		value := 0.0
+		if gu.healthy() {
+			value = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			goproxyUpstreamHealthyDesc,
+			prometheus.GaugeValue,
+			value,
+			gu.redactedURL(),
+		)
+	}
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(
+			collectors.ProcessCollectorOpts{},
+		),
+		httpRequestsTotal,
+		httpRequestDuration,
+		cacheLookupsTotal,
+		cacheServedBytesTotal,
+		cacheScrubbedObjectsTotal,
+		inFlightOperations,
+		goproxyFetchWaitsTotal,
+		rateLimitedRequestsTotal,
+		ttlCacheLookupsTotal,
+		ttlCacheEvictionsTotal,
+		checksumDBVerificationsTotal,
+		storageAttemptsTotal,
+		storageRetryableErrorsTotal,
+		storageBreakerStateGauge,
+		storageBreakerTransitionsTotal,
+		storageBreakerRejectionsTotal,
+		storageMultipartUploadPartDuration,
+		goproxyUpstreamsCollector{},
+	)
+
+	if !metricsEnabled {
+		return
+	}
+
+	metricsHandler := promhttp.HandlerFor(
+		metricsRegistry,
+		promhttp.HandlerOpts{},
+	)
+
+	if metricsAddress == "" {
+		base.Air.BATCH(
+			getHeadMethods,
+			"/metrics",
+			air.WrapHTTPHandler(metricsHandler),
+			authGas,
+		)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler)
+
+	server := &http.Server{
+		Addr:              metricsAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	onStart(func() {
+		go func() {
+			if err := server.ListenAndServe(); err != nil &&
+				!errors.Is(err, http.ErrServerClosed) {
+				base.Logger.Error().Err(err).
+					Msg("metrics server error")
+			}
+		}()
+
+		base.Air.AddShutdownJob(func() {
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				10*time.Second,
+			)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	})
+}
+
+// metricsGas returns a gas that is used to record the HTTP request metrics of
+// the route.
+func metricsGas(route string) air.Gas {
+	return func(next air.Handler) air.Handler {
+		return func(req *air.Request, res *air.Response) error {
+			startTime := time.Now()
+			err := next(req, res)
+
+			status := res.Status
+			if err != nil && !res.Written &&
+				status < http.StatusBadRequest {
+				status = http.StatusInternalServerError
+			}
+
+			kind := metricsRequestKind(req)
+			httpRequestsTotal.WithLabelValues(
+				route,
+				kind,
+				strconv.Itoa(status),
+			).Inc()
+			httpRequestDuration.WithLabelValues(
+				route,
+				kind,
+			).Observe(time.Since(startTime).Seconds())
+
+			return err
+		}
+	}
+}
+
+// metricsRequestKind returns the kind of the file targeted by the req.
+func metricsRequestKind(req *air.Request) string {
+	name, err := url.PathUnescape(req.RawPath())
+	if err != nil {
+		return "other"
+	}
+
+	switch {
+	case strings.HasPrefix(name, "/stats/"):
+		return "stats"
+	case strings.HasPrefix(name, "/sumdb/"):
+		return "sumdb"
+	case strings.HasSuffix(name, "/@latest"):
+		return "@latest"
+	case strings.HasSuffix(name, "/@v/list"):
+		return "list"
+	}
+
+	switch ext := path.Ext(name); ext {
+	case ".info", ".mod", ".zip":
+		return ext
+	}
+
+	return "other"
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/aofei/air"
+)
+
+func TestMetricsRequestKind(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{path: "/example.com/a/@v/list", want: "list"},
+		{path: "/example.com/a/@v/list?foo", want: "list"},
+		{path: "/example.com/a/@latest?foo=bar", want: "@latest"},
+		{path: "/example.com/a/@v/v1.0.0.info", want: ".info"},
+		{path: "/example.com/a/@v/v1.0.0.zip?bar", want: ".zip"},
+		{path: "/sumdb/sum.golang.org/supported", want: "sumdb"},
+		{path: "/stats/summary?foo", want: "stats"},
+		{path: "/example.com/a/@v/%zz", want: "other"},
+		{path: "/?foo.zip", want: "other"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			got := metricsRequestKind(&air.Request{Path: tt.path})
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,642 @@
+package handler
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The keys of the user metadata of the objects in the `minioStorage`.
+const (
+	minioStorageSHA256MetadataKey = "Goproxycn-Sha256"
+	minioStorageMD5MetadataKey    = "Goproxycn-Md5"
+)
+
+// minioStorage implements the `storage` using an S3-compatible object storage
+// (e.g. the Qiniu Cloud Kodo and MinIO).
+type minioStorage struct {
+	client                  *minio.Client
+	core                    *minio.Core
+	bucketName              string
+	multipartUploadPartSize int64
+	retryableStatusCodes    []int
+	retryPolicy             base.RetryPolicy
+}
+
+// newMinIOStorage returns a new instance of the `minioStorage`. Operations
+// failed with the retryableStatusCodes or transient network errors will be
+// retried based on the retryPolicy.
+func newMinIOStorage(
+	endpoint string,
+	region string,
+	accessKey string,
+	secretKey string,
+	bucketName string,
+	forcePathStyle bool,
+	multipartUploadPartSize int64,
+	retryableStatusCodes []int,
+	retryPolicy base.RetryPolicy,
+) (*minioStorage, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := minio.DefaultTransport(endpointURL.Scheme == "https")
+	if err != nil {
+		return nil, err
+	}
+
+	options := &minio.Options{
+		Creds:     credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:    endpointURL.Scheme == "https",
+		Region:    region,
+		Transport: &minioRetryAfterTransport{base: transport},
+	}
+
+	if forcePathStyle {
+		options.BucketLookup = minio.BucketLookupPath
+	} else {
+		options.BucketLookup = minio.BucketLookupDNS
+	}
+
+	endpointURL.Scheme = ""
+	client, err := minio.New(
+		strings.TrimPrefix(endpointURL.String(), "//"),
+		options,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &minioStorage{
+		client:                  client,
+		core:                    &minio.Core{Client: client},
+		bucketName:              bucketName,
+		multipartUploadPartSize: multipartUploadPartSize,
+		retryableStatusCodes:    retryableStatusCodes,
+		retryPolicy:             retryPolicy,
+	}, nil
+}
+
+// Get implements the `storage`.
+func (ms *minioStorage) Get(ctx context.Context, name string) (
+	io.ReadSeekCloser,
+	storageObjectInfo,
+	error,
+) {
+	var (
+		object     *minio.Object
+		objectInfo minio.ObjectInfo
+	)
+
+	if err := ms.do(ctx, "get", name, func(
+		ctx context.Context,
+	) (err error) {
+		object, err = ms.client.GetObject(
+			ctx,
+			ms.bucketName,
+			name,
+			minio.GetObjectOptions{},
+		)
+		if err != nil {
+			return err
+		}
+
+		objectInfo, err = object.Stat()
+		if err != nil {
+			object.Close()
+			return err
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int64(
+			"storage.object_size",
+			objectInfo.Size,
+		))
+
+		return nil
+	}); err != nil {
+		return nil, storageObjectInfo{}, ms.convertError(err)
+	}
+
+	return object, ms.storageObjectInfo(objectInfo), nil
+}
+
+// Stat implements the `storage`.
+func (ms *minioStorage) Stat(
+	ctx context.Context,
+	name string,
+) (storageObjectInfo, error) {
+	var objectInfo minio.ObjectInfo
+	if err := ms.do(ctx, "stat", name, func(
+		ctx context.Context,
+	) (err error) {
+		objectInfo, err = ms.client.StatObject(
+			ctx,
+			ms.bucketName,
+			name,
+			minio.StatObjectOptions{},
+		)
+		return err
+	}); err != nil {
+		return storageObjectInfo{}, ms.convertError(err)
+	}
+
+	return ms.storageObjectInfo(objectInfo), nil
+}
+
+// Put implements the `storage`.
+func (ms *minioStorage) Put(
+	ctx context.Context,
+	name string,
+	content io.ReadSeeker,
+) (err error) {
+	ctx, done := trackInFlightOperation(ctx, "upload")
+	defer done()
+
+	sha256Checksum, md5Checksum, err := storageContentChecksums(content)
+	if err != nil {
+		return err
+	}
+
+	putObjectOptions := minio.PutObjectOptions{
+		ContentType: storageContentType(name),
+		UserMetadata: map[string]string{
+			minioStorageSHA256MetadataKey: hex.EncodeToString(
+				sha256Checksum,
+			),
+			minioStorageMD5MetadataKey: hex.EncodeToString(
+				md5Checksum,
+			),
+		},
+	}
+
+	ctx, span := base.Tracer.Start(
+		ctx,
+		"storage.upload",
+		trace.WithAttributes(
+			attribute.String("storage.object_name", name),
+		),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}()
+
+	var size int64
+	if f, ok := content.(*os.File); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		size = fi.Size()
+	} else if size, err = content.Seek(0, io.SeekEnd); err != nil {
+		return err
+	} else if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	span.SetAttributes(attribute.Int64("storage.object_size", size))
+
+	if size <= ms.multipartUploadPartSize {
+		content := content
+		if ra, ok := content.(io.ReaderAt); ok {
+			content = io.NewSectionReader(ra, 0, size)
+		} else if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		return ms.do(ctx, "put", name, func(ctx context.Context) error {
+			_, err := ms.core.PutObject(
+				ctx,
+				ms.bucketName,
+				name,
+				content,
+				size,
+				"",
+				"",
+				putObjectOptions,
+			)
+			return err
+		})
+	}
+
+	var uploadID string
+	if err := ms.do(ctx, "new_multipart_upload", name, func(
+		ctx context.Context,
+	) (err error) {
+		uploadID, err = ms.core.NewMultipartUpload(
+			ctx,
+			ms.bucketName,
+			name,
+			putObjectOptions,
+		)
+		return err
+	}); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// Abort even if the ctx is canceled, otherwise the uploaded
+		// parts are left behind.
+		ctx, cancel := context.WithTimeout(
+			context.WithoutCancel(ctx),
+			time.Minute,
+		)
+		defer cancel()
+
+		ms.abortMultipartUpload(ctx, name, uploadID)
+	}()
+
+	var completeParts []minio.CompletePart
+	for offset := int64(0); offset < size; {
+		partSize := min(ms.multipartUploadPartSize, size-offset)
+
+		var part minio.ObjectPart
+		if err := ms.do(ctx, "put_object_part", name, func(
+			ctx context.Context,
+		) (err error) {
+			content := content
+			if ra, ok := content.(io.ReaderAt); ok {
+				content = io.NewSectionReader(
+					ra,
+					offset,
+					partSize,
+				)
+			} else if _, err := content.Seek(
+				offset,
+				io.SeekStart,
+			); err != nil {
+				return err
+			}
+
+			trace.SpanFromContext(ctx).SetAttributes(
+				attribute.Int(
+					"storage.part_number",
+					len(completeParts)+1,
+				),
+				attribute.Int64("storage.part_size", partSize),
+			)
+
+			startTime := time.Now()
+			defer func() {
+				storageMultipartUploadPartDuration.Observe(
+					time.Since(startTime).Seconds(),
+				)
+			}()
+
+			part, err = ms.core.PutObjectPart(
+				ctx,
+				ms.bucketName,
+				name,
+				uploadID,
+				len(completeParts)+1,
+				io.LimitReader(content, partSize),
+				partSize,
+				minio.PutObjectPartOptions{},
+			)
+
+			return err
+		}); err != nil {
+			return err
+		}
+
+		completeParts = append(completeParts, minio.CompletePart{
+			PartNumber: part.PartNumber,
+			ETag:       part.ETag,
+		})
+
+		offset += part.Size
+	}
+
+	return ms.do(ctx, "complete_multipart_upload", name, func(
+		ctx context.Context,
+	) error {
+		_, err := ms.core.CompleteMultipartUpload(
+			ctx,
+			ms.bucketName,
+			name,
+			uploadID,
+			completeParts,
+			minio.PutObjectOptions{
+				ContentType: putObjectOptions.ContentType,
+			},
+		)
+		return err
+	})
+}
+
+// Remove implements the `storage`.
+func (ms *minioStorage) Remove(ctx context.Context, name string) error {
+	if err := ms.do(ctx, "remove", name, func(ctx context.Context) error {
+		return ms.client.RemoveObject(
+			ctx,
+			ms.bucketName,
+			name,
+			minio.RemoveObjectOptions{},
+		)
+	}); err != nil && !isNotFoundMinIOError(err) {
+		return err
+	}
+
+	return nil
+}
+
+// List implements the `storage`.
+func (ms *minioStorage) List(
+	ctx context.Context,
+	prefix string,
+	startAfter string,
+) iter.Seq2[storageObjectInfo, error] {
+	return func(yield func(storageObjectInfo, error) bool) {
+		for objectInfo := range ms.client.ListObjectsIter(
+			ctx,
+			ms.bucketName,
+			minio.ListObjectsOptions{
+				Prefix:     prefix,
+				StartAfter: startAfter,
+				Recursive:  true,
+			},
+		) {
+			if objectInfo.Err != nil {
+				yield(storageObjectInfo{}, objectInfo.Err)
+				return
+			}
+
+			if !yield(ms.storageObjectInfo(objectInfo), nil) {
+				return
+			}
+		}
+	}
+}
+
+// AbortStaleUploads implements the `storage`.
+func (ms *minioStorage) AbortStaleUploads(
+	ctx context.Context,
+	maxAge time.Duration,
+) (int, error) {
+	var (
+		count  int
+		cutoff = time.Now().Add(-maxAge)
+	)
+
+	for upload := range ms.client.ListIncompleteUploads(
+		ctx,
+		ms.bucketName,
+		"",
+		true,
+	) {
+		if upload.Err != nil {
+			return count, upload.Err
+		}
+
+		if upload.Initiated.After(cutoff) {
+			continue
+		}
+
+		if err := ms.abortMultipartUpload(
+			ctx,
+			upload.Key,
+			upload.UploadID,
+		); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// Presign implements the `storage`.
+func (ms *minioStorage) Presign(
+	ctx context.Context,
+	method string,
+	name string,
+	expiry time.Duration,
+	reqParams url.Values,
+) (*url.URL, error) {
+	_, span := base.Tracer.Start(
+		ctx,
+		"storage.presign",
+		trace.WithAttributes(
+			attribute.String("storage.object_name", name),
+		),
+	)
+	defer span.End()
+
+	return ms.client.Presign(
+		ctx,
+		method,
+		ms.bucketName,
+		name,
+		expiry,
+		reqParams,
+	)
+}
+
+// abortMultipartUpload aborts the multipart upload of the uploadID for the
+// object targeted by the name.
+func (ms *minioStorage) abortMultipartUpload(
+	ctx context.Context,
+	name string,
+	uploadID string,
+) error {
+	return ms.do(ctx, "abort_multipart_upload", name, func(
+		ctx context.Context,
+	) error {
+		return ms.core.AbortMultipartUpload(
+			ctx,
+			ms.bucketName,
+			name,
+			uploadID,
+		)
+	})
+}
+
+// do does the f as the operation on the object targeted by the name and retries
+// it based on the `ms.retryPolicy` in case of the `ms.retryableStatusCodes` or
+// transient network errors, but not before the "Retry-After" of the responses.
+// The operation is traced as a span.
+func (ms *minioStorage) do(
+	ctx context.Context,
+	operation string,
+	name string,
+	f func(ctx context.Context) error,
+) error {
+	ctx, span := base.Tracer.Start(
+		ctx,
+		"storage."+operation,
+		trace.WithAttributes(
+			attribute.String("storage.object_name", name),
+		),
+	)
+	defer span.End()
+
+	// The codes of the retryable errors in order, as only those of the
+	// attempts that are actually retried are counted.
+	var retryableCodes []string
+
+	retryPolicy := ms.retryPolicy
+	retryPolicy.Classify = func(err error) string {
+		var errorResponse minio.ErrorResponse
+		errors.As(err, &errorResponse)
+
+		var class, code string
+		switch statusCode := errorResponse.StatusCode; {
+		case statusCode == 0:
+			class = base.ClassifyNetworkError(err)
+			code = class
+		case !slices.Contains(ms.retryableStatusCodes, statusCode):
+		case statusCode == 573: // Qiniu Cloud Kodo throttling
+			class = base.RetryClassThrottle
+			code = strconv.Itoa(statusCode)
+		default:
+			class = base.ClassifyHTTPStatusCode(statusCode)
+			code = strconv.Itoa(statusCode)
+		}
+
+		if class != "" {
+			retryableCodes = append(retryableCodes, code)
+		}
+
+		return class
+	}
+
+	stats, err := retryPolicy.Do(ctx, func(ctx context.Context) error {
+		storageAttemptsTotal.WithLabelValues(operation).Inc()
+
+		var retryAfter atomic.Int64
+		err := f(context.WithValue(
+			ctx,
+			minioRetryAfterContextKey{},
+			&retryAfter,
+		))
+		if after := time.Duration(retryAfter.Load()); err != nil &&
+			after > 0 {
+			return &base.RetryAfterError{Err: err, After: after}
+		}
+
+		return err
+	})
+
+	retries := max(stats.Attempts-1, 0)
+	retryableCodes = retryableCodes[:min(retries, len(retryableCodes))]
+	for _, code := range retryableCodes {
+		storageRetryableErrorsTotal.WithLabelValues(
+			operation,
+			code,
+		).Inc()
+	}
+
+	accessLogEntryFromContext(ctx).addStorageRetries(retries)
+
+	if rae, ok := err.(*base.RetryAfterError); ok {
+		err = rae.Err
+	}
+	if err != nil && !isNotFoundMinIOError(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// minioRetryAfterContextKey is the context key of the longest "Retry-After" of
+// the responses to the requests of an attempt of the `minioStorage.do`.
+type minioRetryAfterContextKey struct{}
+
+// minioRetryAfterTransport implements the `http.RoundTripper` to record the
+// "Retry-After" of the responses for the `minioStorage.do`.
+type minioRetryAfterTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (mrat *minioRetryAfterTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	res, err := mrat.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	retryAfter, ok := req.Context().Value(
+		minioRetryAfterContextKey{},
+	).(*atomic.Int64)
+	if !ok {
+		return res, nil
+	}
+
+	after := int64(base.ParseRetryAfter(res.Header.Get("Retry-After")))
+	for {
+		current := retryAfter.Load()
+		if after <= current ||
+			retryAfter.CompareAndSwap(current, after) {
+			break
+		}
+	}
+
+	return res, nil
+}
+
+// convertError converts the err into the `fs.ErrNotExist` if it is a MinIO not
+// found error.
+func (ms *minioStorage) convertError(err error) error {
+	if isNotFoundMinIOError(err) {
+		return fs.ErrNotExist
+	}
+
+	return err
+}
+
+// storageObjectInfo converts the objectInfo into the `storageObjectInfo`.
+func (ms *minioStorage) storageObjectInfo(
+	objectInfo minio.ObjectInfo,
+) storageObjectInfo {
+	soi := storageObjectInfo{
+		Name:         objectInfo.Key,
+		Size:         objectInfo.Size,
+		ETag:         objectInfo.ETag,
+		ContentType:  objectInfo.ContentType,
+		LastModified: objectInfo.LastModified,
+	}
+
+	soi.SHA256, soi.MD5 = parseStorageContentChecksums(
+		objectInfo.UserMetadata[minioStorageSHA256MetadataKey],
+		objectInfo.UserMetadata[minioStorageMD5MetadataKey],
+	)
+
+	return soi
+}
+
+// isNotFoundMinIOError reports whether the err is MinIO not found error.
+func isNotFoundMinIOError(err error) bool {
+	return minio.ToErrorResponse(err).StatusCode == http.StatusNotFound
+}
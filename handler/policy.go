@@ -0,0 +1,555 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// moduleRulesObjectName is the name of the object in the `objectStorage` that
+// holds the module rules managed at runtime (e.g. by takedowns).
+const moduleRulesObjectName = "policy/module-rules.json"
+
+// The actions of the module rules.
+const (
+	// moduleRuleActionAllow allows the matched module versions. Once there
+	// is any allow rule, module versions that match no rule are denied.
+	moduleRuleActionAllow = "allow"
+
+	// moduleRuleActionDeny denies the matched module versions with 403.
+	moduleRuleActionDeny = "deny"
+
+	// moduleRuleActionTakedown denies the matched module versions with
+	// 410.
+	moduleRuleActionTakedown = "takedown"
+
+	// moduleRuleActionRetract hides the matched module versions from the
+	// "list" and "@latest" files but still serves them.
+	moduleRuleActionRetract = "retract"
+)
+
+// moduleRuleVersionOperators is the operators of the module rule version
+// comparisons. Longer ones go first.
+var moduleRuleVersionOperators = []string{">=", "<=", ">", "<", "="}
+
+var (
+	// configModuleRules is the module rules from the configuration file.
+	configModuleRules []moduleRule
+
+	// storedModuleRules is the module rules from the `objectStorage`.
+	storedModuleRules []moduleRule
+
+	// storedModuleRulesLoaded indicates whether the `storedModuleRules`
+	// have been loaded from the `objectStorage`.
+	storedModuleRulesLoaded atomic.Bool
+
+	// moduleRulesMutex guards the `configModuleRules` and the
+	// `storedModuleRules`.
+	moduleRulesMutex sync.RWMutex
+)
+
+// moduleRule is a rule of the module versions that can be served.
+type moduleRule struct {
+	// Path is the comma-separated list of glob patterns (in the syntax of
+	// GOPRIVATE) of the module paths.
+	Path string `mapstructure:"path" json:"path"`
+
+	// Versions is the list of the module version ranges. Each range is an
+	// exact version or space-separated comparisons (e.g. ">=v1.2.0
+	// <v1.3.0") that must all hold. An empty list matches all versions.
+	Versions []string `mapstructure:"versions" json:"versions,omitempty"`
+
+	// Action is the action of the rule.
+	Action string `mapstructure:"action" json:"action"`
+
+	// Reason is the reason of the rule, which is shown to the clients.
+	Reason string `mapstructure:"reason" json:"reason,omitempty"`
+}
+
+// matchVersion reports whether the moduleVersion matches the `mr.Versions`.
+func (mr moduleRule) matchVersion(moduleVersion string) bool {
+	if len(mr.Versions) == 0 {
+		return true
+	}
+
+	for _, versionRange := range mr.Versions {
+		matched := true
+		for comparison := range strings.FieldsSeq(versionRange) {
+			op, version := parseModuleRuleVersionComparison(
+				comparison,
+			)
+			c := semver.Compare(moduleVersion, version)
+			switch op {
+			case ">=":
+				matched = c >= 0
+			case ">":
+				matched = c > 0
+			case "<=":
+				matched = c <= 0
+			case "<":
+				matched = c < 0
+			default:
+				matched = c == 0
+			}
+
+			if !matched {
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseModuleRuleVersionComparison parses the comparison of a module rule
+// version range into its operator (empty for "=") and version.
+func parseModuleRuleVersionComparison(comparison string) (string, string) {
+	for _, op := range moduleRuleVersionOperators {
+		if version, ok := strings.CutPrefix(comparison, op); ok {
+			return op, version
+		}
+	}
+
+	return "", comparison
+}
+
+func init() {
+	if err := base.Viper.UnmarshalKey(
+		"policy.module_rules",
+		&configModuleRules,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal policy module rules")
+	}
+
+	if err := validateModuleRules(configModuleRules); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("invalid policy module rules")
+	}
+
+	base.OnConfigReload([]string{"policy.module_rules"}, func(
+		v *viper.Viper,
+	) (func(), error) {
+		var mrs []moduleRule
+		if err := v.UnmarshalKey(
+			"policy.module_rules",
+			&mrs,
+		); err != nil {
+			return nil, err
+		}
+
+		if err := validateModuleRules(mrs); err != nil {
+			return nil, err
+		}
+
+		return func() {
+			moduleRulesMutex.Lock()
+			configModuleRules = mrs
+			moduleRulesMutex.Unlock()
+		}, nil
+	})
+
+	onStart(startStoredModuleRulesUpdater)
+}
+
+// startStoredModuleRulesUpdater updates the `storedModuleRules` and starts the
+// job that updates them every minute.
+func startStoredModuleRulesUpdater() {
+	if err := updateStoredModuleRules(base.Context); err != nil {
+		base.Logger.Error().Err(err).
+			Msg("failed to update stored module rules")
+	}
+
+	if _, err := base.Cron.AddJob(
+		"* * * * *",
+		cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).
+			Then(cron.FuncJob(func() {
+				if err := updateStoredModuleRules(
+					base.Context,
+				); err != nil {
+					base.Logger.Error().Err(err).
+						Msg("failed to update stored " +
+							"module rules")
+				}
+			})),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add stored module rules update cron " +
+				"job")
+	}
+}
+
+// validateModuleRules validates the mrs.
+func validateModuleRules(mrs []moduleRule) error {
+	for _, mr := range mrs {
+		if strings.TrimSpace(mr.Path) == "" {
+			return errors.New("missing module rule path")
+		}
+
+		switch mr.Action {
+		case moduleRuleActionAllow,
+			moduleRuleActionDeny,
+			moduleRuleActionTakedown,
+			moduleRuleActionRetract:
+		default:
+			return fmt.Errorf(
+				"invalid module rule action: %q",
+				mr.Action,
+			)
+		}
+
+		// Invalid versions are lower than all valid ones, which
+		// would make a comparison with a typo match everything.
+		for _, versionRange := range mr.Versions {
+			if strings.TrimSpace(versionRange) == "" {
+				return errors.New("empty module rule version")
+			}
+
+			for comparison := range strings.FieldsSeq(
+				versionRange,
+			) {
+				_, version := parseModuleRuleVersionComparison(
+					comparison,
+				)
+				if !semver.IsValid(version) {
+					return fmt.Errorf(
+						"invalid module rule version: "+
+							"%q",
+						comparison,
+					)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateStoredModuleRules updates the `storedModuleRules` from the
+// `objectStorage`.
+func updateStoredModuleRules(ctx context.Context) error {
+	mrs, err := getStoredModuleRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	moduleRulesMutex.Lock()
+	storedModuleRules = mrs
+	moduleRulesMutex.Unlock()
+
+	storedModuleRulesLoaded.Store(true)
+
+	return nil
+}
+
+// loadStoredModuleRules updates the `storedModuleRules` from the
+// `objectStorage` if they have never been loaded (e.g. by a one-off command,
+// which does not run the `startStoredModuleRulesUpdater`).
+func loadStoredModuleRules(ctx context.Context) error {
+	if storedModuleRulesLoaded.Load() {
+		return nil
+	}
+
+	return updateStoredModuleRules(ctx)
+}
+
+// getStoredModuleRules gets the module rules from the `objectStorage`.
+func getStoredModuleRules(ctx context.Context) ([]moduleRule, error) {
+	var mrs []moduleRule
+	if err := getJSONObject(
+		ctx,
+		moduleRulesObjectName,
+		&mrs,
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := validateModuleRules(mrs); err != nil {
+		return nil, err
+	}
+
+	return mrs, nil
+}
+
+// moduleRules returns all module rules in order of precedence. The
+// `storedModuleRules` go first, so that takedowns override the
+// `configModuleRules`.
+func moduleRules() []moduleRule {
+	moduleRulesMutex.RLock()
+	defer moduleRulesMutex.RUnlock()
+	return slices.Concat(storedModuleRules, configModuleRules)
+}
+
+// applyModuleRule returns the rule that applies to the module version. An
+// empty moduleVersion means the module itself, which is only denied by the
+// rules without versions. The action of the returned rule is always
+// `moduleRuleActionAllow` if no rule matches and there are no allow rules.
+func applyModuleRule(
+	mrs []moduleRule,
+	modulePath string,
+	moduleVersion string,
+) moduleRule {
+	allowListed := false
+	for _, mr := range mrs {
+		if mr.Action == moduleRuleActionAllow {
+			allowListed = true
+		}
+
+		if !module.MatchPrefixPatterns(mr.Path, modulePath) {
+			continue
+		}
+
+		if moduleVersion == "" {
+			if len(mr.Versions) == 0 ||
+				mr.Action == moduleRuleActionAllow {
+				return mr
+			}
+
+			continue
+		}
+
+		if mr.matchVersion(moduleVersion) {
+			return mr
+		}
+	}
+
+	if allowListed {
+		return moduleRule{
+			Action: moduleRuleActionDeny,
+			Reason: "not in the module allow list",
+		}
+	}
+
+	return moduleRule{Action: moduleRuleActionAllow}
+}
+
+// moduleRuleError returns the error of the mr that denies the req.
+func moduleRuleError(
+	req *air.Request,
+	res *air.Response,
+	mr moduleRule,
+) error {
+	reason := mr.Reason
+	switch mr.Action {
+	case moduleRuleActionTakedown:
+		res.Status = http.StatusGone
+		if reason == "" {
+			reason = "taken down"
+		}
+	default:
+		res.Status = http.StatusForbidden
+		if reason == "" {
+			reason = "denied by policy"
+		}
+	}
+
+	return errors.New(reason)
+}
+
+// serveModuleRules serves the name with the module rules applied. It reports
+// whether the req has been handled, otherwise the req should be served as
+// usual.
+func serveModuleRules(
+	req *air.Request,
+	res *air.Response,
+	name string,
+) (bool, error) {
+	mrs := moduleRules()
+	if len(mrs) == 0 {
+		return false, nil
+	}
+
+	if modulePath, moduleVersion, _, ok := parseGoproxyCacheName(
+		name,
+	); ok {
+		mr := applyModuleRule(mrs, modulePath, moduleVersion)
+		switch mr.Action {
+		case moduleRuleActionDeny, moduleRuleActionTakedown:
+			return true, moduleRuleError(req, res, mr)
+		}
+
+		return false, nil
+	}
+
+	escapedModulePath, isList := strings.CutSuffix(name, "/@v/list")
+	escapedModulePath, isLatest := strings.CutSuffix(
+		escapedModulePath,
+		"/@latest",
+	)
+	if !isList && !isLatest {
+		return false, nil
+	}
+
+	modulePath, err := module.UnescapePath(escapedModulePath)
+	if err != nil {
+		return false, nil
+	}
+
+	switch mr := applyModuleRule(mrs, modulePath, ""); mr.Action {
+	case moduleRuleActionDeny, moduleRuleActionTakedown:
+		return true, moduleRuleError(req, res, mr)
+	}
+
+	if !slices.ContainsFunc(mrs, func(mr moduleRule) bool {
+		return len(mr.Versions) > 0 &&
+			module.MatchPrefixPatterns(mr.Path, modulePath)
+	}) && !slices.ContainsFunc(mrs, func(mr moduleRule) bool {
+		return mr.Action == moduleRuleActionAllow
+	}) {
+		return false, nil
+	}
+
+	servable := func(moduleVersion string) bool {
+		return applyModuleRule(
+			mrs,
+			modulePath,
+			moduleVersion,
+		).Action == moduleRuleActionAllow
+	}
+
+	if isLatest {
+		latest := fetchGoproxy(req.Context, http.MethodGet, name)
+		if latest.status == http.StatusOK {
+			var info struct{ Version string }
+			if err := json.Unmarshal(
+				latest.body.Bytes(),
+				&info,
+			); err == nil && servable(info.Version) {
+				return true, writeGoproxyResponse(res, latest)
+			}
+		}
+	}
+
+	list := fetchGoproxy(
+		req.Context,
+		http.MethodGet,
+		escapedModulePath+"/@v/list",
+	)
+	if list.status != http.StatusOK {
+		return true, writeGoproxyResponse(res, list)
+	}
+
+	var versions []string
+	for version := range strings.FieldsSeq(list.body.String()) {
+		if servable(version) {
+			versions = append(versions, version)
+		}
+	}
+
+	if isList {
+		list.body.Reset()
+		for _, version := range versions {
+			fmt.Fprintln(&list.body, version)
+		}
+
+		return true, writeGoproxyResponse(res, list)
+	}
+
+	semver.Sort(versions)
+	latestVersion := ""
+	for _, version := range slices.Backward(versions) {
+		if latestVersion == "" || semver.Prerelease(version) == "" {
+			latestVersion = version
+			if semver.Prerelease(version) == "" {
+				break
+			}
+		}
+	}
+
+	if latestVersion == "" {
+		return true, NotFound(req, res)
+	}
+
+	escapedLatestVersion, err := module.EscapeVersion(latestVersion)
+	if err != nil {
+		return true, err
+	}
+
+	return true, writeGoproxyResponse(res, fetchGoproxy(
+		req.Context,
+		http.MethodGet,
+		fmt.Sprint(
+			escapedModulePath,
+			"/@v/",
+			escapedLatestVersion,
+			".info",
+		),
+	))
+}
+
+// writeGoproxyResponse writes the grr to the res.
+func writeGoproxyResponse(
+	res *air.Response,
+	grr *goproxyResponseRecorder,
+) error {
+	for key, values := range grr.header {
+		if key != "Content-Length" {
+			res.Header[key] = values
+		}
+	}
+
+	res.Status = grr.status
+
+	return res.Write(bytes.NewReader(grr.body.Bytes()))
+}
+
+// Takedown takes down the module version (or all versions of the module if the
+// moduleVersion is empty) by adding a takedown rule with the reason to the
+// `moduleRulesObjectName` and then purging its cache.
+func Takedown(
+	ctx context.Context,
+	modulePath string,
+	moduleVersion string,
+	reason string,
+) error {
+	if err := module.CheckPath(modulePath); err != nil {
+		return err
+	}
+
+	mr := moduleRule{
+		Path:   modulePath,
+		Action: moduleRuleActionTakedown,
+		Reason: reason,
+	}
+	if moduleVersion != "" {
+		if !semver.IsValid(moduleVersion) {
+			return fmt.Errorf("invalid version: %q", moduleVersion)
+		}
+
+		mr.Versions = []string{moduleVersion}
+	}
+
+	mrs, err := getStoredModuleRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := putJSONObject(
+		ctx,
+		moduleRulesObjectName,
+		append(mrs, mr),
+	); err != nil {
+		return err
+	}
+
+	return PurgeCache(ctx, modulePath, moduleVersion)
+}
@@ -0,0 +1,70 @@
+package handler
+
+import "testing"
+
+func TestValidateModuleRules(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		versions []string
+		wantErr  bool
+	}{
+		{name: "NoVersions"},
+		{name: "Exact", versions: []string{"v1.2.0"}},
+		{
+			name:     "Range",
+			versions: []string{">=v1.2.0 <v1.2.5", "=v1.3.0"},
+		},
+		{
+			name:     "MissingV",
+			versions: []string{">=1.2.0"},
+			wantErr:  true,
+		},
+		{
+			name:     "Typo",
+			versions: []string{">=v1.2.0 <v1,3"},
+			wantErr:  true,
+		},
+		{
+			name:     "MissingVersion",
+			versions: []string{"<="},
+			wantErr:  true,
+		},
+		{name: "Empty", versions: []string{" "}, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateModuleRules([]moduleRule{{
+				Path:     "example.com/a",
+				Versions: tt.versions,
+				Action:   moduleRuleActionDeny,
+			}})
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf(
+					"got error %v, want error %t",
+					err,
+					tt.wantErr,
+				)
+			}
+		})
+	}
+}
+
+func TestModuleRuleMatchVersion(t *testing.T) {
+	mr := moduleRule{Versions: []string{">=v1.2.0 <v1.2.5", "v1.3.0"}}
+	for _, tt := range []struct {
+		version string
+		want    bool
+	}{
+		{version: "v1.1.9", want: false},
+		{version: "v1.2.0", want: true},
+		{version: "v1.2.4", want: true},
+		{version: "v1.2.5", want: false},
+		{version: "v1.3.0", want: true},
+		{version: "v1.3.1", want: false},
+	} {
+		t.Run(tt.version, func(t *testing.T) {
+			if got := mr.matchVersion(tt.version); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
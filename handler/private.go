@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/module"
+)
+
+var (
+	// goproxyPrivates is the private module configurations of the Goproxy.
+	goproxyPrivates []goproxyPrivate
+
+	// goproxyPrivatePatterns is the comma-separated list of glob patterns
+	// (in the syntax of GOPRIVATE) of all private modules.
+	goproxyPrivatePatterns string
+
+	// goproxyPrivateConfigFiles is the config files holding the
+	// credentials of the `goproxyPrivates`, which are written by the
+	// `prepareGoproxyPrivate`.
+	goproxyPrivateConfigFiles []goproxyPrivateConfigFile
+
+	// goproxyPrivateDir is the temporary directory of the
+	// `goproxyPrivateConfigFiles`. It is empty if not created.
+	goproxyPrivateDir string
+
+	// goproxyPrivateOnce and goproxyPrivateErr are used to run the
+	// `prepareGoproxyPrivate` only once.
+	goproxyPrivateOnce sync.Once
+	goproxyPrivateErr  error
+
+	// goproxyPrivateDirMutex protects the `goproxyPrivateDir`.
+	goproxyPrivateDirMutex sync.Mutex
+)
+
+// goproxyPrivate is a private module configuration of the Goproxy.
+type goproxyPrivate struct {
+	// Pattern is the comma-separated list of glob patterns (in the syntax
+	// of GOPRIVATE) of the private modules.
+	Pattern string `mapstructure:"pattern"`
+
+	// NetrcLogin and NetrcPassword are the netrc entry for the hosts of
+	// the private modules.
+	NetrcLogin    string `mapstructure:"netrc_login"`
+	NetrcPassword string `mapstructure:"netrc_password"`
+
+	// SSHKeyFile is the SSH private key file used to clone the private
+	// modules over SSH instead of HTTPS.
+	SSHKeyFile string `mapstructure:"ssh_key_file"`
+
+	// HTTPToken is the bearer token used to clone the private modules over
+	// HTTPS.
+	HTTPToken string `mapstructure:"http_token"`
+}
+
+// goproxyPrivateConfigFile is a config file holding the credentials of the
+// `goproxyPrivates`.
+type goproxyPrivateConfigFile struct {
+	name    string
+	content string
+
+	// env returns the environment variable that points the Go binary to
+	// the file at the path.
+	env func(path string) string
+}
+
+func init() {
+	if err := goproxyViper.UnmarshalKey(
+		"private",
+		&goproxyPrivates,
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to unmarshal goproxy private " +
+				"configuration items")
+	}
+
+	if len(goproxyPrivates) == 0 {
+		return
+	}
+
+	var patterns []string
+	for _, gp := range goproxyPrivates {
+		for pattern := range strings.SplitSeq(gp.Pattern, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+
+	goproxyPrivatePatterns = strings.Join(patterns, ",")
+
+	var err error
+	goproxyPrivateConfigFiles, err = newGoproxyPrivateConfigFiles()
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to prepare goproxy private environment")
+	}
+
+	hhGoproxy.GoBinEnv = goproxyPrivateGoBinEnv()
+
+	onStart(func() {
+		if err := prepareGoproxyPrivate(); err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("failed to prepare goproxy private " +
+					"environment")
+		}
+	})
+
+	onCleanup(removeGoproxyPrivateDir)
+}
+
+// goproxyPrivateGoBinEnv returns the environment of the Go binary targeted by
+// `hhGoproxy.GoBinName` with the `goproxyPrivatePatterns` applied.
+func goproxyPrivateGoBinEnv() []string {
+	goBinEnv := os.Environ()
+	for _, key := range []string{"GOPRIVATE", "GONOPROXY", "GONOSUMDB"} {
+		if value := os.Getenv(key); value != "" {
+			goBinEnv = append(goBinEnv, fmt.Sprint(
+				key,
+				"=",
+				value,
+				",",
+				goproxyPrivatePatterns,
+			))
+		} else if key == "GOPRIVATE" {
+			goBinEnv = append(goBinEnv, fmt.Sprint(
+				key,
+				"=",
+				goproxyPrivatePatterns,
+			))
+		}
+	}
+
+	return goBinEnv
+}
+
+// newGoproxyPrivateConfigFiles returns the netrc file, Git config file and SSH
+// config file for the `goproxyPrivates`. Files without content are omitted.
+func newGoproxyPrivateConfigFiles() ([]goproxyPrivateConfigFile, error) {
+	var gpcs goproxyPrivateConfigs
+	for _, gp := range goproxyPrivates {
+		for pattern := range strings.SplitSeq(gp.Pattern, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+
+			if err := gpcs.add(gp, pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var files []goproxyPrivateConfigFile
+	for _, file := range []goproxyPrivateConfigFile{
+		{
+			name:    "netrc",
+			content: gpcs.netrc.String(),
+			env: func(path string) string {
+				return "NETRC=" + path
+			},
+		},
+		{
+			name:    "gitconfig",
+			content: gpcs.gitConfig.String(),
+			env: func(path string) string {
+				return "GIT_CONFIG_GLOBAL=" + path
+			},
+		},
+		{
+			name:    "ssh_config",
+			content: gpcs.sshConfig.String(),
+			env: func(path string) string {
+				// Git runs it through the shell.
+				return "GIT_SSH_COMMAND=ssh -F " +
+					shellQuote(path)
+			},
+		},
+	} {
+		if file.content != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// prepareGoproxyPrivate writes the `goproxyPrivateConfigFiles` to the
+// `goproxyPrivateDir`, and points the Go binary targeted by the
+// `hhGoproxy.GoBinName` to them. It must be called before the `hhGoproxy` is
+// used, and only the first call does the work.
+//
+// The files hold the credentials in plaintext, so the `goproxyPrivateDir` is
+// only created when needed, and must be removed by the `Cleanup`.
+func prepareGoproxyPrivate() error {
+	goproxyPrivateOnce.Do(func() {
+		if len(goproxyPrivateConfigFiles) == 0 {
+			return
+		}
+
+		goproxyPrivateDirMutex.Lock()
+		defer goproxyPrivateDirMutex.Unlock()
+
+		// The directory is created with the permissions 0700.
+		dir, err := os.MkdirTemp("", "goproxy.cn-private")
+		if err != nil {
+			goproxyPrivateErr = err
+			return
+		}
+
+		goproxyPrivateDir = dir
+
+		goBinEnv := slices.Clip(goproxyUpstreamsBaseGoBinEnv)
+		for _, file := range goproxyPrivateConfigFiles {
+			path := filepath.Join(dir, file.name)
+			if err := os.WriteFile(
+				path,
+				[]byte(file.content),
+				0o600,
+			); err != nil {
+				os.RemoveAll(dir)
+				goproxyPrivateDir = ""
+				goproxyPrivateErr = err
+				return
+			}
+
+			goBinEnv = append(goBinEnv, file.env(path))
+		}
+
+		goproxyUpstreamsBaseGoBinEnv = goBinEnv
+		applyGoproxyUpstreams(hhGoproxy, goproxyUpstreams)
+	})
+
+	return goproxyPrivateErr
+}
+
+// removeGoproxyPrivateDir removes the `goproxyPrivateDir` if it has been
+// created.
+func removeGoproxyPrivateDir() {
+	goproxyPrivateDirMutex.Lock()
+	defer goproxyPrivateDirMutex.Unlock()
+	if goproxyPrivateDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(goproxyPrivateDir); err != nil {
+		base.Logger.Error().Err(err).
+			Str("dir", goproxyPrivateDir).
+			Msg("failed to remove goproxy private directory")
+	}
+
+	goproxyPrivateDir = ""
+}
+
+// shellQuote returns the s quoted for the POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// goproxyPrivateConfigs is the netrc file, Git config file and SSH config file
+// contents for the `goproxyPrivates`.
+type goproxyPrivateConfigs struct {
+	netrcEntries map[string][2]string
+	netrc        strings.Builder
+	gitConfig    strings.Builder
+	sshConfig    strings.Builder
+	sshHostCount int
+}
+
+// add adds the credentials of the gp for the pattern to the gpcs.
+func (gpcs *goproxyPrivateConfigs) add(
+	gp goproxyPrivate,
+	pattern string,
+) error {
+	prefix := goproxyPrivatePatternPrefix(pattern)
+	if prefix == "" {
+		if gp.NetrcLogin != "" ||
+			gp.SSHKeyFile != "" ||
+			gp.HTTPToken != "" {
+			return fmt.Errorf(
+				"cannot apply credentials to pattern with "+
+					"wildcard host: %q",
+				pattern,
+			)
+		}
+
+		return nil
+	}
+
+	host, _, _ := strings.Cut(prefix, "/")
+
+	if gp.NetrcLogin != "" {
+		// A netrc file can only hold one entry per host, so the same
+		// host must not have different netrc entries.
+		entry := [2]string{gp.NetrcLogin, gp.NetrcPassword}
+		hostEntry, ok := gpcs.netrcEntries[host]
+		if ok && hostEntry != entry {
+			return fmt.Errorf(
+				"conflicting netrc credentials for host: %q",
+				host,
+			)
+		} else if !ok {
+			if gpcs.netrcEntries == nil {
+				gpcs.netrcEntries = map[string][2]string{}
+			}
+
+			gpcs.netrcEntries[host] = entry
+
+			fmt.Fprintf(
+				&gpcs.netrc,
+				"machine %s login %s password %s\n",
+				host,
+				gp.NetrcLogin,
+				gp.NetrcPassword,
+			)
+		}
+	}
+
+	if gp.HTTPToken != "" {
+		fmt.Fprintf(
+			&gpcs.gitConfig,
+			"[http %q]\n\textraHeader = %q\n",
+			fmt.Sprint("https://", prefix, "/"),
+			fmt.Sprint("Authorization: Bearer ", gp.HTTPToken),
+		)
+	}
+
+	if gp.SSHKeyFile != "" {
+		sshKeyFile, err := filepath.Abs(gp.SSHKeyFile)
+		if err != nil {
+			return err
+		}
+
+		// Each pattern gets its own SSH host alias so that patterns
+		// sharing the same host can use different SSH keys.
+		sshHost := fmt.Sprint("goproxy-private-", gpcs.sshHostCount)
+		gpcs.sshHostCount++
+
+		fmt.Fprintf(
+			&gpcs.gitConfig,
+			"[url %q]\n\tinsteadOf = %q\n",
+			fmt.Sprint(
+				"ssh://git@",
+				sshHost,
+				strings.TrimPrefix(prefix, host),
+				"/",
+			),
+			fmt.Sprint("https://", prefix, "/"),
+		)
+
+		fmt.Fprintf(
+			&gpcs.sshConfig,
+			"Host %s\n"+
+				"\tHostName %s\n"+
+				"\tIdentityFile %q\n"+
+				"\tIdentitiesOnly yes\n"+
+				"\tStrictHostKeyChecking accept-new\n",
+			sshHost,
+			host,
+			sshKeyFile,
+		)
+	}
+
+	return nil
+}
+
+// goproxyPrivatePatternPrefix returns the leading path elements of the pattern
+// that contain no wildcards. It returns "" if the first path element (the host)
+// of the pattern contains wildcards.
+func goproxyPrivatePatternPrefix(pattern string) string {
+	var elems []string
+	for elem := range strings.SplitSeq(pattern, "/") {
+		if strings.ContainsAny(elem, `*?[\`) {
+			break
+		}
+
+		elems = append(elems, elem)
+	}
+
+	return strings.Join(elems, "/")
+}
+
+// isPrivateModule reports whether the modulePath matches the
+// `goproxyPrivatePatterns`.
+func isPrivateModule(modulePath string) bool {
+	return goproxyPrivatePatterns != "" &&
+		module.MatchPrefixPatterns(goproxyPrivatePatterns, modulePath)
+}
@@ -0,0 +1,587 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+// rateLimitsPrefix is the prefix of the names of the bucket objects of the
+// `storageRateLimitStore` in the `objectStorage`.
+const rateLimitsPrefix = "ratelimits/"
+
+// The budgets of the rate limits.
+const (
+	// rateLimitBudgetRequest is the budget of all requests, most of which
+	// are cheap cache hits.
+	rateLimitBudgetRequest = "request"
+
+	// rateLimitBudgetFetch is the budget of the expensive upstream
+	// fetches caused by the requests.
+	rateLimitBudgetFetch = "fetch"
+)
+
+var (
+	// rateLimitEnabled indicates whether the rate limits are enabled.
+	rateLimitEnabled = base.Viper.GetBool("rate_limit.enabled")
+
+	// rateLimitRules is the rules of the rate limits.
+	rateLimitRules = newReloadable(rateLimitRuleSet{})
+
+	// rateLimitRequestStore is the store of the request budgets. It is
+	// always in process, as sharing it would cost a storage request per
+	// request.
+	rateLimitRequestStore rateLimitStore
+
+	// rateLimitFetchStore is the store of the fetch budgets.
+	rateLimitFetchStore rateLimitStore
+)
+
+func init() {
+	if !rateLimitEnabled {
+		return
+	}
+
+	apply, err := loadRateLimitRules(base.Viper)
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load rate limit rules")
+	}
+
+	apply()
+
+	base.OnConfigReload([]string{
+		"rate_limit.request_rate",
+		"rate_limit.request_burst",
+		"rate_limit.fetch_rate",
+		"rate_limit.fetch_burst",
+		"rate_limit.groups",
+		"rate_limit.trusted_proxies",
+	}, loadRateLimitRules)
+
+	maxClients := base.Viper.GetInt("rate_limit.max_clients")
+	if maxClients <= 0 {
+		maxClients = 100000
+	}
+
+	rateLimitRequestStore = newMemoryRateLimitStore(
+		"rate_limit_requests",
+		maxClients,
+	)
+
+	backend := base.Viper.GetString("rate_limit.fetch_backend")
+	switch backend {
+	case "":
+		rateLimitFetchStore = newMemoryRateLimitStore(
+			"rate_limit_fetches",
+			maxClients,
+		)
+	case "storage":
+		rateLimitFetchStore = storageRateLimitStore{}
+	default:
+		base.Logger.Fatal().Str("backend", backend).
+			Msg("unknown rate limit fetch backend")
+	}
+}
+
+// rateLimit is the limit of a budget of the rate limits.
+type rateLimit struct {
+	// Rate is the number of the tokens refilled per second. Zero means
+	// unlimited.
+	Rate float64
+
+	// Burst is the maximum number of the tokens.
+	Burst int
+}
+
+// newRateLimit returns a new instance of the `rateLimit` with the rate and
+// burst. The burst is at least 1.
+func newRateLimit(rate float64, burst int) rateLimit {
+	return rateLimit{Rate: rate, Burst: max(burst, 1)}
+}
+
+// rateLimitRuleSet is the rules of the rate limits.
+type rateLimitRuleSet struct {
+	request rateLimit
+	fetch   rateLimit
+	groups  []rateLimitGroup
+
+	// trustedProxies is the prefixes of the IPs of the proxies trusted to
+	// forward the IPs of the clients.
+	trustedProxies []netip.Prefix
+}
+
+// rateLimitGroup is a group of the clients sharing the budgets of the rate
+// limits.
+type rateLimitGroup struct {
+	// Name is the name of the group.
+	Name string `mapstructure:"name"`
+
+	// CIDRs is the CIDRs of the client IPs in the group.
+	CIDRs []string `mapstructure:"cidrs"`
+
+	// Subjects is the authenticated subjects in the group.
+	Subjects []string `mapstructure:"subjects"`
+
+	// RequestRate, RequestBurst, FetchRate and FetchBurst override the
+	// default limits of the budgets if not nil.
+	RequestRate  *float64 `mapstructure:"request_rate"`
+	RequestBurst *int     `mapstructure:"request_burst"`
+	FetchRate    *float64 `mapstructure:"fetch_rate"`
+	FetchBurst   *int     `mapstructure:"fetch_burst"`
+
+	prefixes []netip.Prefix
+	request  rateLimit
+	fetch    rateLimit
+}
+
+// loadRateLimitRules loads the rules of the rate limits from the v and returns
+// a function that applies them.
+func loadRateLimitRules(v *viper.Viper) (func(), error) {
+	rlrs := rateLimitRuleSet{
+		request: newRateLimit(
+			v.GetFloat64("rate_limit.request_rate"),
+			v.GetInt("rate_limit.request_burst"),
+		),
+		fetch: newRateLimit(
+			v.GetFloat64("rate_limit.fetch_rate"),
+			v.GetInt("rate_limit.fetch_burst"),
+		),
+	}
+
+	if err := v.UnmarshalKey(
+		"rate_limit.groups",
+		&rlrs.groups,
+	); err != nil {
+		return nil, err
+	}
+
+	for _, cidr := range v.GetStringSlice("rate_limit.trusted_proxies") {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"invalid rate limit trusted proxy: %w",
+				err,
+			)
+		}
+
+		rlrs.trustedProxies = append(
+			rlrs.trustedProxies,
+			prefix.Masked(),
+		)
+	}
+
+	for i := range rlrs.groups {
+		rlg := &rlrs.groups[i]
+		if rlg.Name == "" {
+			return nil, errors.New("missing rate limit group name")
+		}
+
+		for _, cidr := range rlg.CIDRs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"invalid rate limit group %q: %w",
+					rlg.Name,
+					err,
+				)
+			}
+
+			rlg.prefixes = append(rlg.prefixes, prefix.Masked())
+		}
+
+		rlg.request = rlrs.request
+		if rlg.RequestRate != nil {
+			rlg.request.Rate = *rlg.RequestRate
+		}
+
+		if rlg.RequestBurst != nil {
+			rlg.request.Burst = max(*rlg.RequestBurst, 1)
+		}
+
+		rlg.fetch = rlrs.fetch
+		if rlg.FetchRate != nil {
+			rlg.fetch.Rate = *rlg.FetchRate
+		}
+
+		if rlg.FetchBurst != nil {
+			rlg.fetch.Burst = max(*rlg.FetchBurst, 1)
+		}
+	}
+
+	return func() {
+		rateLimitRules.Store(rlrs)
+	}, nil
+}
+
+// rateLimitClientContextKey is the context key of the `rateLimitClient`.
+type rateLimitClientContextKey struct{}
+
+// rateLimitClient is a client of the rate limits.
+type rateLimitClient struct {
+	key     string
+	request rateLimit
+	fetch   rateLimit
+}
+
+// newRateLimitClient returns a new instance of the `rateLimitClient` for the
+// req. The client is keyed by the first group matching its authenticated
+// subject or IP, then by its authenticated subject, and finally by its IP.
+func newRateLimitClient(req *air.Request) *rateLimitClient {
+	rlrs := rateLimitRules.Load()
+
+	subject, _ := req.Value(authSubjectKey).(string)
+	addr := rateLimitClientAddr(req, rlrs.trustedProxies)
+
+	for _, rlg := range rlrs.groups {
+		if subject != "" && slices.Contains(rlg.Subjects, subject) ||
+			addr.IsValid() && slices.ContainsFunc(
+				rlg.prefixes,
+				func(prefix netip.Prefix) bool {
+					return prefix.Contains(addr)
+				},
+			) {
+			return &rateLimitClient{
+				key:     "group:" + rlg.Name,
+				request: rlg.request,
+				fetch:   rlg.fetch,
+			}
+		}
+	}
+
+	rlc := &rateLimitClient{
+		key:     "ip:" + req.RemoteHost(),
+		request: rlrs.request,
+		fetch:   rlrs.fetch,
+	}
+	if subject != "" {
+		rlc.key = "subject:" + subject
+	} else if addr.IsValid() {
+		rlc.key = "ip:" + addr.String()
+	}
+
+	return rlc
+}
+
+// rateLimitClientAddr returns the IP of the client of the req. It is the IP of
+// the peer unless it is one of the trustedProxies, in which case the
+// X-Forwarded-For is walked from the right to the first IP that is not, as the
+// ones to its left can be forged by the client.
+func rateLimitClientAddr(
+	req *air.Request,
+	trustedProxies []netip.Prefix,
+) netip.Addr {
+	trusted := func(addr netip.Addr) bool {
+		return slices.ContainsFunc(
+			trustedProxies,
+			func(prefix netip.Prefix) bool {
+				return prefix.Contains(addr)
+			},
+		)
+	}
+
+	addr, err := netip.ParseAddr(req.RemoteHost())
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	addr = addr.Unmap()
+	if !trusted(addr) {
+		return addr
+	}
+
+	hops := strings.Split(
+		strings.Join(req.Header.Values("X-Forwarded-For"), ","),
+		",",
+	)
+	for _, hop := range slices.Backward(hops) {
+		hopAddr, err := netip.ParseAddr(strings.TrimSpace(hop))
+		if err != nil {
+			break
+		}
+
+		addr = hopAddr.Unmap()
+		if !trusted(addr) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// rateLimitClientFromContext returns the `rateLimitClient` in the ctx, or nil
+// if not found.
+func rateLimitClientFromContext(ctx context.Context) *rateLimitClient {
+	rlc, _ := ctx.Value(rateLimitClientContextKey{}).(*rateLimitClient)
+	return rlc
+}
+
+// take takes n tokens from the budget of the rlc. It returns how long until the
+// budget has a token if it has none left, in which case nothing is taken.
+//
+// Note that the errors of the stores are logged and ignored, so the rate limits
+// never fail the requests.
+func (rlc *rateLimitClient) take(
+	ctx context.Context,
+	budget string,
+	n int,
+) time.Duration {
+	store, limit := rateLimitRequestStore, rlc.request
+	if budget == rateLimitBudgetFetch {
+		store, limit = rateLimitFetchStore, rlc.fetch
+	}
+
+	if limit.Rate <= 0 {
+		return 0
+	}
+
+	wait, err := store.Take(ctx, rlc.key, limit, n)
+	if err != nil {
+		base.Logger.Error().Err(err).
+			Str("key", rlc.key).
+			Str("budget", budget).
+			Msg("failed to take rate limit tokens")
+		return 0
+	}
+
+	return wait
+}
+
+// rateLimitGas is used to limit the rate of the requests of each client by the
+// request budget. It does nothing if the `rateLimitEnabled` is false.
+func rateLimitGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		if !rateLimitEnabled {
+			return next(req, res)
+		}
+
+		rlc := newRateLimitClient(req)
+		if wait := rlc.take(
+			req.Context,
+			rateLimitBudgetRequest,
+			1,
+		); wait > 0 {
+			rateLimitedRequestsTotal.WithLabelValues(
+				rateLimitBudgetRequest,
+			).Inc()
+			return TooManyRequests(req, res, wait)
+		}
+
+		req.Context = context.WithValue(
+			req.Context,
+			rateLimitClientContextKey{},
+			rlc,
+		)
+
+		return next(req, res)
+	}
+}
+
+// serveRateLimit refuses the req for the name with a 429 if it would cause an
+// upstream fetch while the fetch budget of its client is used up. It reports
+// whether the req has been handled, otherwise the req should be served as
+// usual.
+//
+// The requests that are not for the cached module files (e.g. the "list" files)
+// always fetch, so they take the fetch tokens here. The others only take them
+// on cache misses (see the `takeRateLimitFetch`).
+func serveRateLimit(
+	req *air.Request,
+	res *air.Response,
+	name string,
+) (bool, error) {
+	rlc := rateLimitClientFromContext(req.Context)
+	if rlc == nil || strings.HasPrefix(name, "sumdb/") {
+		return false, nil
+	}
+
+	var wait time.Duration
+	if validGoproxyCacheName(name) {
+		wait = rlc.take(req.Context, rateLimitBudgetFetch, 0)
+		if wait > 0 {
+			// Cache hits are still served.
+			if _, err := objectStorage.Stat(
+				req.Context,
+				name,
+			); err == nil {
+				return false, nil
+			}
+		}
+	} else {
+		wait = rlc.take(req.Context, rateLimitBudgetFetch, 1)
+	}
+
+	if wait == 0 {
+		return false, nil
+	}
+
+	rateLimitedRequestsTotal.WithLabelValues(rateLimitBudgetFetch).Inc()
+
+	return true, TooManyRequests(req, res, wait)
+}
+
+// takeRateLimitFetch takes a fetch token from the `rateLimitClient` in the ctx
+// (if any) for the fetch of the cached module file targeted by the name.
+func takeRateLimitFetch(ctx context.Context, name string) {
+	if !validGoproxyCacheName(name) {
+		return
+	}
+
+	if rlc := rateLimitClientFromContext(ctx); rlc != nil {
+		rlc.take(ctx, rateLimitBudgetFetch, 1)
+	}
+}
+
+// TooManyRequests returns too many requests error with the retryAfter.
+func TooManyRequests(
+	req *air.Request,
+	res *air.Response,
+	retryAfter time.Duration,
+) error {
+	res.Status = http.StatusTooManyRequests
+	res.Header.Set("Cache-Control", "no-store")
+	res.Header.Set("Retry-After", strconv.FormatInt(
+		int64(math.Ceil(retryAfter.Seconds())),
+		10,
+	))
+	return errors.New(strings.ToLower(http.StatusText(res.Status)))
+}
+
+// rateLimitStore defines a set of methods used to store the token buckets of
+// the rate limits.
+type rateLimitStore interface {
+	// Take takes n tokens from the bucket of the key under the limit if
+	// it has at least one token left. Otherwise, nothing is taken and it
+	// returns how long until the bucket has one.
+	Take(
+		ctx context.Context,
+		key string,
+		limit rateLimit,
+		n int,
+	) (time.Duration, error)
+}
+
+// rateLimitBucket is a token bucket of the rate limits.
+type rateLimitBucket struct {
+	Tokens    float64   `json:"tokens"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// take refills the rlb under the limit at the now and then takes n tokens from
+// it. It returns the updated bucket and how long until it has a token if it
+// has none left, in which case nothing is taken.
+func (rlb rateLimitBucket) take(
+	limit rateLimit,
+	n int,
+	now time.Time,
+) (rateLimitBucket, time.Duration) {
+	if rlb.UpdatedAt.IsZero() {
+		rlb.Tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(rlb.UpdatedAt); elapsed > 0 {
+		rlb.Tokens = min(
+			rlb.Tokens+elapsed.Seconds()*limit.Rate,
+			float64(limit.Burst),
+		)
+	}
+
+	rlb.UpdatedAt = now
+
+	if rlb.Tokens < 1 {
+		return rlb, time.Duration(
+			(1 - rlb.Tokens) / limit.Rate * float64(time.Second),
+		)
+	}
+
+	rlb.Tokens -= float64(n)
+
+	return rlb, 0
+}
+
+// memoryRateLimitStore implements the `rateLimitStore` in process.
+type memoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets *ttlCache[rateLimitBucket]
+}
+
+// newMemoryRateLimitStore returns a new instance of the `memoryRateLimitStore`
+// that keeps the buckets of at most maxKeys keys in the `ttlCache` of the name.
+func newMemoryRateLimitStore(
+	name string,
+	maxKeys int,
+) *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: newTTLCache[rateLimitBucket](name, maxKeys),
+	}
+}
+
+// Take implements the `rateLimitStore`.
+func (mrls *memoryRateLimitStore) Take(
+	ctx context.Context,
+	key string,
+	limit rateLimit,
+	n int,
+) (time.Duration, error) {
+	mrls.mutex.Lock()
+	defer mrls.mutex.Unlock()
+
+	rlb, _ := mrls.buckets.Get(key)
+	rlb, wait := rlb.take(limit, n, time.Now())
+
+	// A bucket is as good as gone once it is full again.
+	refillSeconds := (float64(limit.Burst) - rlb.Tokens) / limit.Rate
+	mrls.buckets.Set(
+		key,
+		rlb,
+		time.Duration(refillSeconds*float64(time.Second))+time.Second,
+	)
+
+	return wait, nil
+}
+
+// storageRateLimitStore implements the `rateLimitStore` using the bucket
+// objects in the `objectStorage`, which shares the buckets across replicas.
+//
+// Note that the `objectStorage` does not support conditional writes, so the
+// concurrent takes of a bucket may overwrite each other. This is fine as the
+// rate limits only need to be roughly enforced.
+type storageRateLimitStore struct{}
+
+// Take implements the `rateLimitStore`.
+func (srls storageRateLimitStore) Take(
+	ctx context.Context,
+	key string,
+	limit rateLimit,
+	n int,
+) (time.Duration, error) {
+	name := rateLimitsPrefix + url.PathEscape(key) + ".json"
+
+	var rlb rateLimitBucket
+	if err := getJSONObject(
+		ctx,
+		name,
+		&rlb,
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	rlb, wait := rlb.take(limit, n, time.Now())
+	if wait > 0 || n == 0 {
+		return wait, nil
+	}
+
+	return 0, putJSONObject(ctx, name, rlb)
+}
@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+// The strategies of the redirects.
+const (
+	// redirectStrategyPresign redirects to the presigned URLs of the
+	// objects in the `objectStorage`.
+	redirectStrategyPresign = "presign"
+
+	// redirectStrategyQiniuCDN redirects to the CDN URLs signed with the
+	// Qiniu Cloud timestamp anti-leech.
+	redirectStrategyQiniuCDN = "qiniu_cdn"
+
+	// redirectStrategyHMACCDN redirects to the CDN URLs signed with the
+	// HMAC-SHA256 of the escaped path followed by the expiry timestamp.
+	redirectStrategyHMACCDN = "hmac_cdn"
+)
+
+var (
+	// redirectStrategy is the strategy of the redirects.
+	redirectStrategy = base.Viper.GetString("redirect.strategy")
+
+	// redirectExpiry is the expiry of the redirect URLs.
+	redirectExpiry = base.Viper.GetDuration("redirect.expiry")
+
+	// redirectCacheControl is the Cache-Control header of the responses of
+	// the presigned URLs.
+	redirectCacheControl = base.Viper.GetString("redirect.cache_control")
+
+	// redirectCDNBaseURL is the base URL of the CDN.
+	redirectCDNBaseURL *url.URL
+
+	// redirectCDNSignKey is the key used to sign the CDN URLs.
+	redirectCDNSignKey = base.Viper.GetString("redirect.cdn_sign_key")
+
+	// redirectHMACExpiresParam is the query parameter of the expiry
+	// timestamp of the CDN URLs signed by the `redirectStrategyHMACCDN`.
+	redirectHMACExpiresParam = base.Viper.GetString(
+		"redirect.hmac_expires_param",
+	)
+
+	// redirectHMACSignatureParam is the query parameter of the signature of
+	// the CDN URLs signed by the `redirectStrategyHMACCDN`.
+	redirectHMACSignatureParam = base.Viper.GetString(
+		"redirect.hmac_signature_param",
+	)
+
+	// redirectRules is the rules of the redirects. It is empty if the
+	// redirects are disabled.
+	redirectRules = newReloadable[[]redirectRule](nil)
+
+	// redirectStatCacheTTL is the TTL of the `redirectObjectInfos`.
+	redirectStatCacheTTL = base.Viper.GetDuration("redirect.stat_cache_ttl")
+
+	// redirectObjectInfos is the cache of the infos of the objects that
+	// may be redirected to. It is nil if disabled.
+	redirectObjectInfos *ttlCache[storageObjectInfo]
+
+	// redirectURLs is the cache of the redirect URLs, which are reused
+	// until 90% of the `redirectExpiry` has elapsed. It is nil if
+	// disabled.
+	redirectURLs *ttlCache[*url.URL]
+)
+
+func init() {
+	if !base.Viper.GetBool("redirect.enabled") && !goproxyAutoRedirect {
+		return
+	}
+
+	rules, err := loadRedirectRules(base.Viper)
+	if err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to load redirect rules")
+	}
+
+	redirectRules.Store(rules)
+
+	base.OnConfigReload([]string{
+		"redirect.rules",
+		"goproxy.auto_redirect_min_size",
+	}, func(v *viper.Viper) (func(), error) {
+		rules, err := loadRedirectRules(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return func() {
+			redirectRules.Store(rules)
+		}, nil
+	})
+
+	if redirectStrategy == "" {
+		redirectStrategy = redirectStrategyPresign
+	}
+
+	if redirectExpiry <= 0 {
+		redirectExpiry = 7 * 24 * time.Hour
+	}
+
+	switch redirectStrategy {
+	case redirectStrategyPresign:
+	case redirectStrategyQiniuCDN, redirectStrategyHMACCDN:
+		if redirectCDNBaseURL, err = url.Parse(
+			base.Viper.GetString("redirect.cdn_base_url"),
+		); err != nil || redirectCDNBaseURL.Host == "" {
+			base.Logger.Fatal().Err(err).
+				Msg("invalid redirect cdn base url")
+		}
+
+		if redirectCDNSignKey == "" {
+			base.Logger.Fatal().
+				Msg("missing redirect cdn sign key")
+		}
+
+		if redirectHMACExpiresParam == "" {
+			redirectHMACExpiresParam = "expires"
+		}
+
+		if redirectHMACSignatureParam == "" {
+			redirectHMACSignatureParam = "signature"
+		}
+	default:
+		base.Logger.Fatal().
+			Str("strategy", redirectStrategy).
+			Msg("unknown redirect strategy")
+	}
+
+	cacheMaxEntries := base.Viper.GetInt("redirect.cache_max_entries")
+	if cacheMaxEntries <= 0 {
+		cacheMaxEntries = 100_000
+	}
+
+	if redirectStatCacheTTL > 0 {
+		redirectObjectInfos = newTTLCache[storageObjectInfo](
+			"redirect_stat",
+			cacheMaxEntries,
+		)
+	}
+
+	if base.Viper.GetBool("redirect.url_cache_enabled") {
+		redirectURLs = newTTLCache[*url.URL](
+			"redirect_url",
+			cacheMaxEntries,
+		)
+	}
+}
+
+// redirectRule is a rule of the cached module files that can be redirected.
+type redirectRule struct {
+	// Extension is the extension of the cached module files.
+	Extension string `mapstructure:"extension"`
+
+	// MinSize is the minimum size of the cached module files.
+	MinSize int64 `mapstructure:"min_size"`
+}
+
+// loadRedirectRules loads the redirect rules from the v. It defaults to the
+// ".zip" files of at least the "goproxy.auto_redirect_min_size".
+func loadRedirectRules(v *viper.Viper) ([]redirectRule, error) {
+	var rules []redirectRule
+	if err := v.UnmarshalKey("redirect.rules", &rules); err != nil {
+		return nil, err
+	}
+
+	if len(rules) == 0 {
+		rules = []redirectRule{{
+			Extension: ".zip",
+			MinSize:   v.GetInt64("goproxy.auto_redirect_min_size"),
+		}}
+	}
+
+	for _, rr := range rules {
+		switch rr.Extension {
+		case ".info", ".mod", ".zip":
+		default:
+			return nil, fmt.Errorf(
+				"invalid redirect rule extension: %q",
+				rr.Extension,
+			)
+		}
+	}
+
+	return rules, nil
+}
+
+// serveRedirect serves the name by redirecting to its object in the
+// `objectStorage` if it matches the `redirectRules`. It reports whether the
+// req has been handled, otherwise the req should be served as usual.
+func serveRedirect(
+	req *air.Request,
+	res *air.Response,
+	name string,
+) (bool, error) {
+	rules := redirectRules.Load()
+	i := slices.IndexFunc(rules, func(rr redirectRule) bool {
+		return rr.Extension == path.Ext(name)
+	})
+	if i < 0 {
+		return false, nil
+	}
+
+	rule := rules[i]
+
+	if strings.Contains(name, "..") {
+		for _, part := range strings.Split(name, "/") {
+			if part == ".." {
+				return true, CacheableNotFound(req, res, 86400)
+			}
+		}
+	}
+
+	name = strings.TrimPrefix(path.Clean(name), "/")
+	modulePath, _, _, ok := parseGoproxyCacheName(name)
+	if !ok {
+		return true, CacheableNotFound(req, res, 86400)
+	} else if isPrivateModule(modulePath) {
+		return false, nil
+	}
+
+	objectInfo, err := redirectObjectInfo(req.Context, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) ||
+			errors.Is(err, errStorageCircuitOpen) {
+			return false, nil
+		}
+
+		return true, err
+	}
+
+	if objectInfo.Size < rule.MinSize {
+		return false, nil
+	}
+
+	u, err := cachedRedirectURL(req.Context, req.Method, name)
+	if err != nil {
+		if errors.Is(err, errors.ErrUnsupported) {
+			return false, nil
+		}
+
+		return true, err
+	}
+
+	accessLogEntryFromContext(req.Context).setCacheOutcome(
+		accessLogCacheOutcomeRedirect,
+	)
+
+	return true, res.Redirect(u.String())
+}
+
+// redirectObjectInfo returns the info of the object targeted by the name from
+// the `redirectObjectInfos` or the `objectStorage`. As the cached module files
+// never change, the infos only expire to catch up with the removals in other
+// processes.
+func redirectObjectInfo(
+	ctx context.Context,
+	name string,
+) (storageObjectInfo, error) {
+	if redirectObjectInfos == nil {
+		return objectStorage.Stat(ctx, name)
+	}
+
+	if objectInfo, ok := redirectObjectInfos.Get(name); ok {
+		return objectInfo, nil
+	}
+
+	objectInfo, err := objectStorage.Stat(ctx, name)
+	if err != nil {
+		return storageObjectInfo{}, err
+	}
+
+	redirectObjectInfos.Set(name, objectInfo, redirectStatCacheTTL)
+
+	return objectInfo, nil
+}
+
+// cachedRedirectURL returns the `redirectURL` from the `redirectURLs` if
+// possible.
+func cachedRedirectURL(
+	ctx context.Context,
+	method string,
+	name string,
+) (*url.URL, error) {
+	if redirectURLs == nil {
+		return redirectURL(ctx, method, name)
+	}
+
+	key := method + " " + name
+	if u, ok := redirectURLs.Get(key); ok {
+		return u, nil
+	}
+
+	u, err := redirectURL(ctx, method, name)
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURLs.Set(key, u, redirectExpiry*9/10)
+
+	return u, nil
+}
+
+// redirectURL returns the URL for the method to access the object targeted by
+// the name based on the `redirectStrategy`.
+func redirectURL(
+	ctx context.Context,
+	method string,
+	name string,
+) (*url.URL, error) {
+	if redirectStrategy == redirectStrategyPresign {
+		reqParams := url.Values{}
+		if redirectCacheControl != "" {
+			reqParams.Set(
+				"response-cache-control",
+				redirectCacheControl,
+			)
+		}
+
+		return objectStorage.Presign(
+			ctx,
+			method,
+			name,
+			redirectExpiry,
+			reqParams,
+		)
+	}
+
+	u := redirectCDNBaseURL.JoinPath(name)
+	escapedPath := u.EscapedPath()
+	expiresAt := time.Now().Add(redirectExpiry).Unix()
+
+	query := u.Query()
+	switch redirectStrategy {
+	case redirectStrategyQiniuCDN:
+		t := strconv.FormatInt(expiresAt, 16)
+		sign := md5.Sum([]byte(redirectCDNSignKey + escapedPath + t))
+		query.Set("sign", hex.EncodeToString(sign[:]))
+		query.Set("t", t)
+	case redirectStrategyHMACCDN:
+		expires := strconv.FormatInt(expiresAt, 10)
+		mac := hmac.New(sha256.New, []byte(redirectCDNSignKey))
+		mac.Write([]byte(escapedPath + expires))
+		query.Set(redirectHMACExpiresParam, expires)
+		query.Set(
+			redirectHMACSignatureParam,
+			hex.EncodeToString(mac.Sum(nil)),
+		)
+	default:
+		return nil, fmt.Errorf(
+			"unknown redirect strategy: %q",
+			redirectStrategy,
+		)
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u, nil
+}
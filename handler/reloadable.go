@@ -0,0 +1,26 @@
+package handler
+
+import "sync/atomic"
+
+// reloadable is a configuration value that can be replaced atomically when the
+// configuration is reloaded.
+type reloadable[T any] struct {
+	p atomic.Pointer[T]
+}
+
+// newReloadable returns a new instance of the `reloadable` with the v.
+func newReloadable[T any](v T) *reloadable[T] {
+	r := &reloadable[T]{}
+	r.Store(v)
+	return r
+}
+
+// Load returns the current value of the r.
+func (r *reloadable[T]) Load() T {
+	return *r.p.Load()
+}
+
+// Store replaces the value of the r with the v.
+func (r *reloadable[T]) Store(v T) {
+	r.p.Store(&v)
+}
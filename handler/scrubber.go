@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/robfig/cron/v3"
+)
+
+// scrubberCursorObjectName is the name of the object in the `objectStorage`
+// that holds the cursor of the scrubber, so that a pass over the cached module
+// files can be resumed across runs and replicas.
+const scrubberCursorObjectName = "scrubber/cursor.json"
+
+// scrubberLeaseTTL is the TTL of the lease of the scrubber, which is renewed
+// while it runs.
+const scrubberLeaseTTL = 5 * time.Minute
+
+var (
+	// scrubberBatchSize is the maximum number of the cached module files
+	// verified in each run of the scrubber.
+	scrubberBatchSize = base.Viper.GetInt("scrubber.batch_size")
+
+	// scrubberQuarantine indicates whether the invalid cached module files
+	// are quarantined instead of being removed.
+	scrubberQuarantine = base.Viper.GetBool("scrubber.quarantine")
+
+	// scrubberLeaser is used to keep the replicas from running the
+	// scrubber at the same time, as they share the `scrubberCursor`.
+	scrubberLeaser *storageFetchLeaser
+)
+
+func init() {
+	if !base.Viper.GetBool("scrubber.enabled") {
+		return
+	}
+
+	if scrubberBatchSize <= 0 {
+		scrubberBatchSize = 1000
+	}
+
+	var err error
+	if scrubberLeaser, err = newStorageFetchLeaser(); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to create scrubber leaser")
+	}
+
+	onStart(startScrubber)
+}
+
+// startScrubber starts the job that scrubs the goproxy cache.
+func startScrubber() {
+	if _, err := base.Cron.AddJob(
+		base.Viper.GetString("scrubber.schedule"),
+		cron.NewChain(
+			cron.SkipIfStillRunning(cron.DiscardLogger),
+		).Then(cron.FuncJob(func() {
+			err := scrubCache(base.Context)
+			if err == nil {
+				return
+			}
+
+			base.Logger.Error().Err(err).
+				Msg("failed to scrub goproxy cache")
+		})),
+	); err != nil {
+		base.Logger.Fatal().Err(err).
+			Msg("failed to add goproxy cache scrub cron job")
+	}
+}
+
+// scrubberCursor is the cursor of the scrubber.
+type scrubberCursor struct {
+	// StartAfter is the name of the last visited object. An empty value
+	// means a new pass.
+	StartAfter string `json:"start_after"`
+
+	// PassStartedAt is the time when the current pass started.
+	PassStartedAt time.Time `json:"pass_started_at"`
+}
+
+// scrubCache verifies the next batch of the cached module files after the
+// `scrubberCursor` stored in the `objectStorage` and discards the invalid ones.
+// It does nothing if another replica holds the lease of the scrubber.
+func scrubCache(ctx context.Context) error {
+	acquired, err := scrubberLeaser.Acquire(
+		ctx,
+		scrubberCursorObjectName,
+		scrubberLeaseTTL,
+	)
+	if err != nil {
+		return err
+	} else if !acquired {
+		return nil
+	}
+	defer func() {
+		if err := scrubberLeaser.Release(
+			context.WithoutCancel(ctx),
+			scrubberCursorObjectName,
+		); err != nil {
+			base.Logger.Error().Err(err).
+				Msg("failed to release scrubber lease")
+		}
+	}()
+
+	var sc scrubberCursor
+	if err := getJSONObject(
+		ctx,
+		scrubberCursorObjectName,
+		&sc,
+	); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if sc.StartAfter == "" {
+		sc.PassStartedAt = time.Now().UTC()
+	}
+
+	checked, passFinished, leasedAt := 0, true, time.Now()
+	for object, err := range objectStorage.List(ctx, "", sc.StartAfter) {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !validGoproxyCacheName(object.Name) {
+			sc.StartAfter = object.Name
+			continue
+		}
+
+		if checked >= scrubberBatchSize {
+			passFinished = false
+			break
+		}
+
+		if time.Since(leasedAt) >= scrubberLeaseTTL/2 {
+			if acquired, err := scrubberLeaser.Acquire(
+				ctx,
+				scrubberCursorObjectName,
+				scrubberLeaseTTL,
+			); err != nil {
+				return err
+			} else if !acquired {
+				return errors.New("lost scrubber lease")
+			}
+
+			leasedAt = time.Now()
+		}
+
+		scrubCacheObject(ctx, object.Name)
+		sc.StartAfter = object.Name
+		checked++
+	}
+
+	if passFinished {
+		base.Logger.Info().
+			Time("pass_started_at", sc.PassStartedAt).
+			Msg("finished goproxy cache scrub pass")
+
+		sc.StartAfter = ""
+	}
+
+	return putJSONObject(ctx, scrubberCursorObjectName, sc)
+}
+
+// scrubCacheObject verifies the cached module file targeted by the name and
+// discards it if it is invalid.
+func scrubCacheObject(ctx context.Context, name string) {
+	err := verifyCacheObject(ctx, name)
+	switch {
+	case err == nil:
+		cacheScrubbedObjectsTotal.WithLabelValues("ok").Inc()
+	case errors.Is(err, fs.ErrNotExist):
+	case errors.Is(err, errCacheObjectMissingChecksums):
+		cacheScrubbedObjectsTotal.WithLabelValues(
+			"missing_checksums",
+		).Inc()
+		base.Logger.Warn().Str("name", name).
+			Msg("found goproxy cache object missing checksums")
+	case errors.Is(err, errInvalidCacheObject):
+		cacheScrubbedObjectsTotal.WithLabelValues("invalid").Inc()
+		base.Logger.Warn().Err(err).Str("name", name).
+			Msg("found invalid goproxy cache object")
+
+		if err := discardCacheObject(
+			ctx,
+			name,
+			scrubberQuarantine,
+		); err != nil {
+			base.Logger.Error().Err(err).Str("name", name).
+				Msg("failed to discard goproxy cache object")
+		}
+	default:
+		cacheScrubbedObjectsTotal.WithLabelValues("error").Inc()
+		base.Logger.Error().Err(err).Str("name", name).
+			Msg("failed to verify goproxy cache object")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"path"
@@ -14,30 +16,34 @@ import (
 
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy.cn/base"
-	"github.com/minio/minio-go/v7"
 	"golang.org/x/mod/module"
 )
 
 // moduleVersionStat is the module version statastic.
 type moduleVersionStat struct {
-	DownloadCount int `json:"download_count"`
-	Last30Days    []struct {
-		Date          time.Time `json:"date"`
-		DownloadCount int       `json:"download_count"`
-	} `json:"last_30_days"`
-	Top10ModuleVersions []struct {
-		ModuleVersion string `json:"module_version"`
-		DownloadCount int    `json:"download_count"`
-	} `json:"top_10_module_versions,omitempty"`
+	DownloadCount       int                          `json:"download_count"`
+	Last30Days          []dailyDownloadCount         `json:"last_30_days"`
+	Top10ModuleVersions []moduleVersionDownloadCount `json:"top_10_module_versions,omitempty"`
+
+	// AppliedRecords is only used by the aggregation and never served.
+	AppliedRecords statAppliedRecords `json:"applied_records,omitempty"`
+}
+
+// dailyDownloadCount is the download count of a single day.
+type dailyDownloadCount struct {
+	Date          time.Time `json:"date"`
+	DownloadCount int       `json:"download_count"`
+}
+
+// moduleVersionDownloadCount is the download count of a module version.
+type moduleVersionDownloadCount struct {
+	ModuleVersion string `json:"module_version"`
+	DownloadCount int    `json:"download_count"`
 }
 
 // updateLast30Days updates `mvs.Last30Days` to the date.
 func (mvs *moduleVersionStat) updateLast30Days(date time.Time) {
-	last30Days := make([]struct {
-		Date          time.Time `json:"date"`
-		DownloadCount int       `json:"download_count"`
-	}, 30)
-
+	last30Days := make([]dailyDownloadCount, 30)
 	for i := range len(last30Days) {
 		last30Days[i].Date = date.AddDate(0, 0, -i)
 		for _, d := range mvs.Last30Days {
@@ -51,11 +57,40 @@ func (mvs *moduleVersionStat) updateLast30Days(date time.Time) {
 	mvs.Last30Days = last30Days
 }
 
+var (
+	// statStaleObjects is the last known stats objects, which are served
+	// stale while the `objectStorageBreaker` is open. It is nil if the
+	// `objectStorageBreaker` is disabled.
+	statStaleObjects *ttlCache[statStaleObject]
+
+	// statStaleObjectTTL is the TTL of the `statStaleObjects`.
+	statStaleObjectTTL = storageViper.GetDuration("breaker.stale_stats_ttl")
+)
+
+// statStaleObject is an entry of the `statStaleObjects`.
+type statStaleObject struct {
+	content    []byte
+	objectInfo storageObjectInfo
+}
+
 func init() {
+	if storageViper.GetBool("breaker.enabled") {
+		if statStaleObjectTTL <= 0 {
+			statStaleObjectTTL = 24 * time.Hour
+		}
+
+		statStaleObjects = newTTLCache[statStaleObject](
+			"stat_stale_objects",
+			10_000,
+		)
+	}
+
 	base.Air.BATCH(
 		getHeadMethods,
 		"/stats/summary",
 		hStatSummary,
+		metricsGas("hStatSummary"),
+		authGas,
 		minutelyCachemanGas,
 	)
 
@@ -63,42 +98,31 @@ func init() {
 		getHeadMethods,
 		"/stats/trends/:Trend",
 		hStatTrend,
+		metricsGas("hStatTrend"),
+		authGas,
 		hourlyCachemanGas,
 	)
 
-	base.Air.BATCH(getHeadMethods, "/stats/*", hStat, hourlyCachemanGas)
+	base.Air.BATCH(
+		getHeadMethods,
+		"/stats/*",
+		hStat,
+		metricsGas("hStat"),
+		authGas,
+		hourlyCachemanGas,
+	)
 
 	base.Air.BATCH(getHeadMethods, "/stats", hStatsPage)
 }
 
 // hStatSummary handles requests to query stat summary.
 func hStatSummary(req *air.Request, res *air.Response) error {
-	var (
-		object     *minio.Object
-		objectInfo minio.ObjectInfo
+	object, objectInfo, err := getStatObject(
+		req.Context,
+		"stats/summary",
 	)
-
-	if err := retryQiniuKodoDo(req.Context, func(
-		ctx context.Context,
-	) (err error) {
-		object, err = qiniuKodoClient.GetObject(
-			ctx,
-			qiniuKodoBucketName,
-			"stats/summary",
-			minio.GetObjectOptions{},
-		)
-		if err != nil {
-			return err
-		}
-
-		objectInfo, err = object.Stat()
-		if err != nil {
-			object.Close()
-		}
-
-		return err
-	}); err != nil {
-		if isNotFoundMinIOError(err) {
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return NotFound(req, res)
 		}
 
@@ -125,32 +149,12 @@ func hStatTrend(req *air.Request, res *air.Response) error {
 		return NotFound(req, res)
 	}
 
-	var (
-		object     *minio.Object
-		objectInfo minio.ObjectInfo
+	object, objectInfo, err := getStatObject(
+		req.Context,
+		fmt.Sprint("stats/trends/", trend),
 	)
-
-	if err := retryQiniuKodoDo(req.Context, func(
-		ctx context.Context,
-	) (err error) {
-		object, err = qiniuKodoClient.GetObject(
-			ctx,
-			qiniuKodoBucketName,
-			fmt.Sprint("stats/trends/", trend),
-			minio.GetObjectOptions{},
-		)
-		if err != nil {
-			return err
-		}
-
-		objectInfo, err = object.Stat()
-		if err != nil {
-			object.Close()
-		}
-
-		return err
-	}); err != nil {
-		if isNotFoundMinIOError(err) {
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return NotFound(req, res)
 		}
 
@@ -170,8 +174,6 @@ func hStatTrend(req *air.Request, res *air.Response) error {
 
 // hStat handles requests to query stat.
 func hStat(req *air.Request, res *air.Response) error {
-	const downloadCountBadgeSuffix = "/badges/download-count.svg"
-
 	name, err := url.PathUnescape(req.ParamValue("*").String())
 	if err != nil || strings.HasSuffix(name, "/") {
 		return CacheableNotFound(req, res, 86400)
@@ -191,19 +193,27 @@ func hStat(req *air.Request, res *air.Response) error {
 		name,
 		downloadCountBadgeSuffix,
 	)
+
+	var modulePath string
 	if hasDownloadCountBadgeSuffix {
-		if module.CheckPath(strings.TrimSuffix(
-			name,
-			downloadCountBadgeSuffix,
-		)) != nil {
+		modulePath = strings.TrimSuffix(name, downloadCountBadgeSuffix)
+		if module.CheckPath(modulePath) != nil {
 			return CacheableNotFound(req, res, 86400)
 		}
 	} else if path, version, found := strings.Cut(name, "@"); found {
 		if module.Check(path, version) != nil {
 			return CacheableNotFound(req, res, 86400)
 		}
+
+		modulePath = path
 	} else if module.CheckPath(name) != nil {
 		return CacheableNotFound(req, res, 86400)
+	} else {
+		modulePath = name
+	}
+
+	if isPrivateModule(modulePath) {
+		return NotFound(req, res)
 	}
 
 	date := time.Now().UTC()
@@ -218,32 +228,12 @@ func hStat(req *air.Request, res *air.Response) error {
 		time.UTC,
 	)
 
-	var (
-		object     *minio.Object
-		objectInfo minio.ObjectInfo
+	object, objectInfo, err := getStatObject(
+		req.Context,
+		path.Join("stats", name),
 	)
-
-	if err := retryQiniuKodoDo(req.Context, func(
-		ctx context.Context,
-	) (err error) {
-		object, err = qiniuKodoClient.GetObject(
-			ctx,
-			qiniuKodoBucketName,
-			path.Join("stats", name),
-			minio.GetObjectOptions{},
-		)
-		if err != nil {
-			return err
-		}
-
-		objectInfo, err = object.Stat()
-		if err != nil {
-			object.Close()
-		}
-
-		return err
-	}); err != nil {
-		if isNotFoundMinIOError(err) {
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			if hasDownloadCountBadgeSuffix {
 				res.Header.Set("Content-Type", "image/svg+xml")
 				return res.WriteFile("unknown-badge.svg")
@@ -290,6 +280,7 @@ func hStat(req *air.Request, res *air.Response) error {
 	}
 
 	stat.updateLast30Days(date)
+	stat.AppliedRecords = nil
 
 	statJSON, err := json.Marshal(stat)
 	if err != nil {
@@ -309,3 +300,51 @@ func hStatsPage(req *air.Request, res *air.Response) error {
 		"IsStatsPage":   true,
 	}, req.LocalizedString("stats.html"), "layouts/default.html")
 }
+
+// getStatObject gets the stats object targeted by the name from the
+// `objectStorage`, or from the `statStaleObjects` while the
+// `objectStorageBreaker` is open.
+func getStatObject(ctx context.Context, name string) (
+	io.ReadSeekCloser,
+	storageObjectInfo,
+	error,
+) {
+	object, objectInfo, err := objectStorage.Get(ctx, name)
+	if statStaleObjects == nil {
+		return object, objectInfo, err
+	} else if err != nil {
+		if errors.Is(err, errStorageCircuitOpen) {
+			if sso, ok := statStaleObjects.Get(name); ok {
+				return statStaleObjectReader{
+					bytes.NewReader(sso.content),
+				}, sso.objectInfo, nil
+			}
+		}
+
+		return nil, storageObjectInfo{}, err
+	}
+	defer object.Close()
+
+	content, err := io.ReadAll(object)
+	if err != nil {
+		return nil, storageObjectInfo{}, err
+	}
+
+	statStaleObjects.Set(
+		name,
+		statStaleObject{content: content, objectInfo: objectInfo},
+		statStaleObjectTTL,
+	)
+
+	return statStaleObjectReader{bytes.NewReader(content)}, objectInfo, nil
+}
+
+// statStaleObjectReader is the reader of the content of a `statStaleObject`.
+type statStaleObjectReader struct {
+	*bytes.Reader
+}
+
+// Close implements the `io.Closer`.
+func (statStaleObjectReader) Close() error {
+	return nil
+}
@@ -0,0 +1,327 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goproxy/goproxy.cn/base"
+)
+
+var (
+	// storageViper is used to get the configuration items of the storage.
+	storageViper = base.SubViper("storage")
+
+	// objectStorage is the storage of all objects, including module files
+	// and stats.
+	objectStorage storage
+
+	// defaultStorageRetryPolicy is the default `base.RetryPolicy` of the
+	// `objectStorage` operations, overridden by the configuration items of
+	// the storage.retry.
+	defaultStorageRetryPolicy = base.RetryPolicy{
+		MaxAttempts:     10,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     5 * time.Second,
+		Multiplier:      2,
+		Jitter:          true,
+		MaxElapsedTime:  time.Minute,
+	}
+)
+
+// storage defines a set of methods used to manage objects in an object
+// storage.
+//
+// All methods return the `fs.ErrNotExist` when the target object does not
+// exist.
+type storage interface {
+	// Get gets the object targeted by the name.
+	Get(ctx context.Context, name string) (
+		io.ReadSeekCloser,
+		storageObjectInfo,
+		error,
+	)
+
+	// Stat returns the info of the object targeted by the name.
+	Stat(ctx context.Context, name string) (storageObjectInfo, error)
+
+	// Put puts the content as the object targeted by the name. The
+	// checksums of the content are stored along with the object.
+	Put(ctx context.Context, name string, content io.ReadSeeker) error
+
+	// Remove removes the object targeted by the name. It does nothing if
+	// the object does not exist.
+	Remove(ctx context.Context, name string) error
+
+	// List lists all objects whose names have the prefix and are lexically
+	// greater than the startAfter in lexical order.
+	List(ctx context.Context, prefix, startAfter string) iter.Seq2[
+		storageObjectInfo,
+		error,
+	]
+
+	// AbortStaleUploads aborts the incomplete uploads started more than
+	// the maxAge ago and returns the number of them.
+	AbortStaleUploads(ctx context.Context, maxAge time.Duration) (
+		int,
+		error,
+	)
+
+	// Presign returns a presigned URL for the method to access the object
+	// targeted by the name within the expiry. The reqParams are added to
+	// the URL as response header overrides.
+	//
+	// It returns the `errors.ErrUnsupported` if presigned URLs are not
+	// supported.
+	Presign(
+		ctx context.Context,
+		method string,
+		name string,
+		expiry time.Duration,
+		reqParams url.Values,
+	) (*url.URL, error)
+}
+
+// storageObjectInfo is the info of an object in the `storage`.
+type storageObjectInfo struct {
+	Name         string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+
+	// SHA256 and MD5 are the checksums of the content stored along with
+	// the object. They are nil if unknown (e.g. the object was put before
+	// the checksums were stored, or it is listed).
+	SHA256 []byte
+	MD5    []byte
+}
+
+// newStorage returns a new instance of the `storage` based on the
+// configuration items. It is guarded by the `objectStorageBreaker` if enabled.
+func newStorage() (storage, error) {
+	s, err := newStorageBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	if !storageViper.GetBool("breaker.enabled") {
+		return s, nil
+	}
+
+	objectStorageBreaker = newStorageBreaker(
+		base.SubViper("storage.breaker"),
+	)
+
+	return &breakerStorage{
+		storage: s,
+		breaker: objectStorageBreaker,
+	}, nil
+}
+
+// newStorageBackend returns a new instance of the `storage` of the backend
+// based on the configuration items.
+func newStorageBackend() (storage, error) {
+	retryPolicy, err := defaultStorageRetryPolicy.WithConfig(
+		base.SubViper("storage.retry"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage retry policy: %w", err)
+	}
+
+	switch backend := storageViper.GetString("backend"); backend {
+	case "", "kodo":
+		return newMinIOStorage(
+			base.Viper.GetString("qiniu.kodo_endpoint"),
+			"",
+			base.Viper.GetString("qiniu.access_key"),
+			base.Viper.GetString("qiniu.secret_key"),
+			base.Viper.GetString("qiniu.kodo_bucket_name"),
+			base.Viper.GetBool("qiniu.kodo_force_path_style"),
+			base.Viper.GetInt64(
+				"qiniu.kodo_multipart_upload_part_size",
+			),
+			[]int{573, 579, 599},
+			retryPolicy,
+		)
+	case "s3":
+		return newMinIOStorage(
+			storageViper.GetString("s3_endpoint"),
+			storageViper.GetString("s3_region"),
+			storageViper.GetString("s3_access_key"),
+			storageViper.GetString("s3_secret_key"),
+			storageViper.GetString("s3_bucket_name"),
+			storageViper.GetBool("s3_force_path_style"),
+			storageViper.GetInt64("s3_multipart_upload_part_size"),
+			[]int{500, 502, 503, 504},
+			retryPolicy,
+		)
+	case "filesystem":
+		return newFileSystemStorage(
+			storageViper.GetString("filesystem_root"),
+		)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %q", backend)
+	}
+}
+
+// internalStoragePrefixes is the object name prefixes of the internal objects
+// in the `objectStorage`, which are not Goproxy caches.
+var internalStoragePrefixes = []string{
+	"stats/",
+	"policy/",
+	"scrubber/",
+	fetchLeasesPrefix,
+	rateLimitsPrefix,
+	accessLogsPrefix,
+	quarantinePrefix,
+}
+
+// isInternalStorageObject reports whether the object targeted by the name is
+// an internal object in the `objectStorage`.
+func isInternalStorageObject(name string) bool {
+	return slices.ContainsFunc(
+		internalStoragePrefixes,
+		func(prefix string) bool {
+			return strings.HasPrefix(name, prefix)
+		},
+	)
+}
+
+// storageContentType returns the content type of the object targeted by the
+// name.
+func storageContentType(name string) string {
+	if quarantinedName, ok := strings.CutPrefix(
+		name,
+		quarantinePrefix,
+	); ok {
+		return storageContentType(quarantinedName)
+	} else if strings.HasPrefix(name, accessLogsPrefix) {
+		return "application/x-ndjson"
+	} else if strings.HasSuffix(name, downloadCountBadgeSuffix) {
+		return "image/svg+xml"
+	} else if isInternalStorageObject(name) {
+		return "application/json; charset=utf-8"
+	}
+
+	switch path.Base(name) {
+	case "@latest":
+		return "application/json; charset=utf-8"
+	case "list":
+		return "text/plain; charset=utf-8"
+	}
+
+	switch path.Ext(name) {
+	case ".info":
+		return "application/json; charset=utf-8"
+	case ".mod":
+		return "text/plain; charset=utf-8"
+	case ".zip":
+		return "application/zip"
+	}
+
+	return "application/octet-stream"
+}
+
+// matchChecksums reports whether the sha256Checksum and md5Checksum of a
+// content match the known checksums of the soi. The `storageObjectInfo.ETag`
+// is used as the MD5 checksum if the `storageObjectInfo.MD5` is unknown and it
+// is one.
+func (soi storageObjectInfo) matchChecksums(
+	sha256Checksum []byte,
+	md5Checksum []byte,
+) bool {
+	if soi.SHA256 != nil && !bytes.Equal(soi.SHA256, sha256Checksum) {
+		return false
+	}
+
+	wantMD5Checksum := soi.MD5
+	if wantMD5Checksum == nil {
+		eTag, err := hex.DecodeString(soi.ETag)
+		if err == nil && len(eTag) == md5.Size {
+			wantMD5Checksum = eTag
+		}
+	}
+
+	return wantMD5Checksum == nil ||
+		bytes.Equal(wantMD5Checksum, md5Checksum)
+}
+
+// storageContentChecksums returns the SHA-256 and MD5 checksums of the
+// content. The content is rewound before and after reading.
+func storageContentChecksums(content io.ReadSeeker) (
+	sha256Checksum []byte,
+	md5Checksum []byte,
+	err error,
+) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	sha256Hash, md5Hash := sha256.New(), md5.New()
+	if _, err := io.Copy(
+		io.MultiWriter(sha256Hash, md5Hash),
+		content,
+	); err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	return sha256Hash.Sum(nil), md5Hash.Sum(nil), nil
+}
+
+// parseStorageContentChecksums parses the hex-encoded SHA-256 and MD5 checksums
+// stored along with an object. Invalid ones are returned as nil.
+func parseStorageContentChecksums(sha256Hex, md5Hex string) (
+	sha256Checksum []byte,
+	md5Checksum []byte,
+) {
+	sha256Checksum, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(sha256Checksum) != sha256.Size {
+		sha256Checksum = nil
+	}
+
+	md5Checksum, err = hex.DecodeString(md5Hex)
+	if err != nil || len(md5Checksum) != md5.Size {
+		md5Checksum = nil
+	}
+
+	return sha256Checksum, md5Checksum
+}
+
+// getJSONObject gets the JSON object targeted by the name from the
+// `objectStorage` and decodes it into the v.
+func getJSONObject(ctx context.Context, name string, v any) error {
+	object, _, err := objectStorage.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	return json.NewDecoder(object).Decode(v)
+}
+
+// putJSONObject puts the v as the JSON object targeted by the name to the
+// `objectStorage`.
+func putJSONObject(ctx context.Context, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return objectStorage.Put(ctx, name, bytes.NewReader(b))
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingTrustedPeers is the prefixes of the IPs of the peers whose propagated
+// traces are continued.
+var tracingTrustedPeers []netip.Prefix
+
+func init() {
+	trustedPeers := base.Viper.GetStringSlice("tracing.trusted_peers")
+	for _, cidr := range trustedPeers {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			base.Logger.Fatal().Err(err).
+				Msg("invalid tracing trusted peer")
+		}
+
+		tracingTrustedPeers = append(
+			tracingTrustedPeers,
+			prefix.Masked(),
+		)
+	}
+}
+
+// TracingGas is used to trace every request as a span, which continues the
+// trace propagated by the peer (if any) if it is one of the
+// `tracingTrustedPeers`. Otherwise, the peer could force its requests to be
+// sampled.
+func TracingGas(next air.Handler) air.Handler {
+	return func(req *air.Request, res *air.Response) error {
+		ctx := req.Context
+		if addr, err := netip.ParseAddr(
+			req.RemoteHost(),
+		); err == nil && slices.ContainsFunc(
+			tracingTrustedPeers,
+			func(prefix netip.Prefix) bool {
+				return prefix.Contains(addr.Unmap())
+			},
+		) {
+			ctx = otel.GetTextMapPropagator().Extract(
+				ctx,
+				propagation.HeaderCarrier(req.Header),
+			)
+		}
+
+		ctx, span := base.Tracer.Start(
+			ctx,
+			req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String(
+					"http.request.method",
+					req.Method,
+				),
+				attribute.String("url.path", req.Path),
+				attribute.String(
+					"client.address",
+					req.ClientHost(),
+				),
+			),
+		)
+		req.Context = ctx
+
+		res.Defer(func() {
+			span.SetAttributes(attribute.Int(
+				"http.response.status_code",
+				res.Status,
+			))
+			if res.Status >= http.StatusInternalServerError {
+				span.SetStatus(
+					codes.Error,
+					http.StatusText(res.Status),
+				)
+			}
+
+			span.End()
+		})
+
+		err := next(req, res)
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		return err
+	}
+}
+
+// annotateGoproxySpan annotates the span in the ctx with the module path,
+// module version and file kind in the name of a request to the Go module proxy.
+func annotateGoproxySpan(ctx context.Context, name string) {
+	modulePath, moduleVersion, fileKind := parseGoproxyRequestName(name)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("goproxy.module_path", modulePath),
+		attribute.String("goproxy.module_version", moduleVersion),
+		attribute.String("goproxy.file_kind", fileKind),
+	)
+}
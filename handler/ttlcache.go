@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a bounded LRU cache whose entries expire after their TTLs. Its
+// lookups and evictions are recorded in the metrics with its name.
+type ttlCache[V any] struct {
+	name       string
+	maxEntries int
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// ttlCacheEntry is an entry of the `ttlCache`.
+type ttlCacheEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+// newTTLCache returns a new instance of the `ttlCache` with the name.
+func newTTLCache[V any](name string, maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{
+		name:       name,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the value of the key. It reports whether the value is found and
+// has not expired.
+func (tc *ttlCache[V]) Get(key string) (V, bool) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	e, ok := tc.entries[key]
+	if ok && time.Now().After(e.Value.(*ttlCacheEntry[V]).expiresAt) {
+		tc.removeElement(e)
+		ok = false
+	}
+
+	if !ok {
+		ttlCacheLookupsTotal.WithLabelValues(tc.name, "miss").Inc()
+		var zero V
+		return zero, false
+	}
+
+	ttlCacheLookupsTotal.WithLabelValues(tc.name, "hit").Inc()
+	tc.lru.MoveToFront(e)
+
+	return e.Value.(*ttlCacheEntry[V]).value, true
+}
+
+// Set sets the value of the key with the ttl.
+func (tc *ttlCache[V]) Set(key string, value V, ttl time.Duration) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if e, ok := tc.entries[key]; ok {
+		tc.removeElement(e)
+	}
+
+	tc.entries[key] = tc.lru.PushFront(&ttlCacheEntry[V]{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	})
+
+	for len(tc.entries) > tc.maxEntries {
+		tc.removeElement(tc.lru.Back())
+		ttlCacheEvictionsTotal.WithLabelValues(tc.name).Inc()
+	}
+}
+
+// Remove removes the value of the key.
+func (tc *ttlCache[V]) Remove(key string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if e, ok := tc.entries[key]; ok {
+		tc.removeElement(e)
+	}
+}
+
+// removeElement removes the e from the tc.
+func (tc *ttlCache[V]) removeElement(e *list.Element) {
+	delete(tc.entries, tc.lru.Remove(e).(*ttlCacheEntry[V]).key)
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproxy/goproxy"
+	"github.com/goproxy/goproxy.cn/base"
+	"github.com/spf13/viper"
+)
+
+var (
+	// goproxyUpstreams is the ordered upstream list (in the syntax of
+	// GOPROXY) of the Goproxy. If it is empty, the GOPROXY environment
+	// variable is used.
+	goproxyUpstreams = goproxyViper.GetString("upstreams")
+
+	// goproxyUpstreamUnhealthyThreshold is the number of consecutive
+	// failures for an upstream of the Goproxy to be considered unhealthy.
+	goproxyUpstreamUnhealthyThreshold = goproxyViper.GetInt(
+		"upstream_unhealthy_threshold",
+	)
+
+	// goproxyUpstreamUnhealthyCooldown is the duration an unhealthy
+	// upstream of the Goproxy will be skipped before it is tried again.
+	goproxyUpstreamUnhealthyCooldown = goproxyViper.GetDuration(
+		"upstream_unhealthy_cooldown",
+	)
+
+	// goproxyUpstreamsBaseGoBinEnv and goproxyUpstreamsBaseTransport are
+	// the `hhGoproxy.GoBinEnv` and the `hhGoproxy.Transport` before the
+	// `goproxyUpstreams` are applied.
+	goproxyUpstreamsBaseGoBinEnv  []string
+	goproxyUpstreamsBaseTransport http.RoundTripper
+)
+
+func init() {
+	goproxyUpstreamsBaseGoBinEnv = hhGoproxy.GoBinEnv
+	goproxyUpstreamsBaseTransport = hhGoproxy.Transport
+	applyGoproxyUpstreams(hhGoproxy, goproxyUpstreams)
+
+	// As the `goproxy.Goproxy` cannot be changed once it starts serving,
+	// a new one is built with the reloaded upstreams.
+	base.OnConfigReload([]string{"goproxy.upstreams"}, func(
+		v *viper.Viper,
+	) (func(), error) {
+		g := &goproxy.Goproxy{
+			GoBinName:           hhGoproxy.GoBinName,
+			GoBinMaxWorkers:     hhGoproxy.GoBinMaxWorkers,
+			PathPrefix:          hhGoproxy.PathPrefix,
+			Cacher:              hhGoproxy.Cacher,
+			CacherMaxCacheBytes: hhGoproxy.CacherMaxCacheBytes,
+			ProxiedSUMDBs:       hhGoproxy.ProxiedSUMDBs,
+			TempDir:             hhGoproxy.TempDir,
+			ErrorLogger:         hhGoproxy.ErrorLogger,
+		}
+		applyGoproxyUpstreams(g, v.GetString("goproxy.upstreams"))
+
+		return func() {
+			servedGoproxy.Store(g)
+		}, nil
+	})
+}
+
+// applyGoproxyUpstreams applies the upstreams (in the syntax of GOPROXY) to the
+// g based on the `goproxyUpstreamsBaseGoBinEnv` and the
+// `goproxyUpstreamsBaseTransport`. If the upstreams is empty, the GOPROXY
+// environment variable is used.
+func applyGoproxyUpstreams(g *goproxy.Goproxy, upstreams string) {
+	g.GoBinEnv = goproxyUpstreamsBaseGoBinEnv
+	g.Transport = goproxyUpstreamsBaseTransport
+
+	if upstreams == "" {
+		upstreams = os.Getenv("GOPROXY")
+	} else {
+		goBinEnv := g.GoBinEnv
+		if goBinEnv == nil {
+			goBinEnv = os.Environ()
+		}
+
+		// The last value of the duplicate keys is used by the g.
+		g.GoBinEnv = append(
+			slices.Clip(goBinEnv),
+			"GOPROXY="+upstreams,
+		)
+	}
+
+	if goproxyUpstreamUnhealthyThreshold <= 0 {
+		return
+	}
+
+	gut := &goproxyUpstreamTransport{base: g.Transport}
+	for rest := upstreams; rest != ""; {
+		proxy, sep := rest, byte(0)
+		if i := strings.IndexAny(rest, ",|"); i >= 0 {
+			proxy, sep, rest = rest[:i], rest[i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+
+		switch proxy = strings.TrimSpace(proxy); proxy {
+		case "", "direct", "off":
+			continue
+		}
+
+		if !strings.Contains(proxy, "://") {
+			proxy = "https://" + proxy
+		}
+
+		gu := &goproxyUpstream{
+			url: strings.TrimSuffix(proxy, "/") + "/",
+		}
+
+		// The fast failures must match the fallback rule of the
+		// separator that follows the gu, which falls back on any
+		// error for the "|" but only on not found for the ",".
+		// There is nothing to fall back to for the last one.
+		switch {
+		case sep == '|':
+			gu.fastFailureStatusCode = http.StatusMisdirectedRequest
+		case sep == ',' && strings.Trim(rest, ", ") != "":
+			gu.fastFailureStatusCode = http.StatusNotFound
+		}
+
+		gut.upstreams = append(gut.upstreams, gu)
+	}
+
+	if len(gut.upstreams) > 0 {
+		g.Transport = gut
+	}
+}
+
+// currentGoproxyUpstreams returns the upstreams of the `servedGoproxy` whose
+// health states are tracked.
+func currentGoproxyUpstreams() []*goproxyUpstream {
+	gut, ok := servedGoproxy.Load().Transport.(*goproxyUpstreamTransport)
+	if !ok {
+		return nil
+	}
+
+	return gut.upstreams
+}
+
+// goproxyUpstream is an upstream of the Goproxy with its health state.
+type goproxyUpstream struct {
+	url string
+
+	// fastFailureStatusCode is the status code of the responses of the
+	// requests to the unhealthy upstream. Zero means the requests are
+	// still sent.
+	fastFailureStatusCode int
+
+	mutex               sync.Mutex
+	consecutiveFailures int
+	lastFailedAt        time.Time
+}
+
+// healthy reports whether the gu is healthy. An unhealthy gu is considered
+// healthy again once the `goproxyUpstreamUnhealthyCooldown` has elapsed since
+// its last failure, and the next failure will make it unhealthy again.
+func (gu *goproxyUpstream) healthy() bool {
+	gu.mutex.Lock()
+	defer gu.mutex.Unlock()
+	return gu.consecutiveFailures < goproxyUpstreamUnhealthyThreshold ||
+		time.Since(gu.lastFailedAt) >= goproxyUpstreamUnhealthyCooldown
+}
+
+// redactedURL returns the URL of the gu with any password redacted.
+func (gu *goproxyUpstream) redactedURL() string {
+	u, err := url.Parse(gu.url)
+	if err != nil {
+		return gu.url
+	}
+
+	return u.Redacted()
+}
+
+// report reports the result of a request to the gu.
+func (gu *goproxyUpstream) report(failed bool) {
+	gu.mutex.Lock()
+	defer gu.mutex.Unlock()
+
+	if !failed {
+		if gu.consecutiveFailures >= goproxyUpstreamUnhealthyThreshold {
+			base.Logger.Info().Str("upstream", gu.redactedURL()).
+				Msg("goproxy upstream recovered")
+		}
+
+		gu.consecutiveFailures = 0
+
+		return
+	}
+
+	gu.consecutiveFailures++
+	gu.lastFailedAt = time.Now()
+	if gu.consecutiveFailures == goproxyUpstreamUnhealthyThreshold {
+		base.Logger.Warn().Str("upstream", gu.redactedURL()).
+			Msg("goproxy upstream became unhealthy")
+	}
+}
+
+// goproxyUpstreamTransport implements the `http.RoundTripper`. It tracks the
+// health states of the upstreams of the Goproxy and fails the requests to the
+// unhealthy ones fast.
+type goproxyUpstreamTransport struct {
+	base      http.RoundTripper
+	upstreams []*goproxyUpstream
+}
+
+// RoundTrip implements the `http.RoundTripper`.
+func (gut *goproxyUpstreamTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	base := gut.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	var upstream *goproxyUpstream
+	for _, gu := range gut.upstreams {
+		if strings.HasPrefix(req.URL.String(), gu.url) {
+			upstream = gu
+			break
+		}
+	}
+
+	if upstream == nil {
+		return base.RoundTrip(req)
+	}
+
+	if upstream.fastFailureStatusCode != 0 && !upstream.healthy() {
+		const body = "goproxy.cn: upstream is unhealthy"
+		return &http.Response{
+			Status: fmt.Sprintf(
+				"%d %s",
+				upstream.fastFailureStatusCode,
+				http.StatusText(upstream.fastFailureStatusCode),
+			),
+			StatusCode:    upstream.fastFailureStatusCode,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			upstream.report(true)
+		}
+
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		upstream.report(true)
+	default:
+		upstream.report(false)
+	}
+
+	return res, nil
+}
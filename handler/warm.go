@@ -0,0 +1,434 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aofei/air"
+	"github.com/goproxy/goproxy.cn/base"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+var (
+	// warmEnabled indicates whether the warm endpoint is enabled.
+	warmEnabled = base.Viper.GetBool("warm.enabled")
+
+	// warmConcurrency is the maximum number of module versions warmed at
+	// the same time.
+	warmConcurrency = base.Viper.GetInt("warm.concurrency")
+)
+
+func init() {
+	if warmEnabled {
+		base.Air.POST(
+			"/warm",
+			hWarm,
+			metricsGas("hWarm"),
+			authGas,
+			rateLimitGas,
+		)
+	}
+}
+
+// hWarm handles requests to warm the cache with a go.mod, go.sum or module
+// version list in the request body. The progress is streamed back as plain
+// text.
+//
+// As the `authGas` can only authorize the request itself, each target is
+// authorized against its own policy, and those that are not are skipped.
+func hWarm(req *air.Request, res *air.Response) error {
+	// Form bodies have already been consumed by the form parsing.
+	switch mediaType, _, _ := mime.ParseMediaType(
+		req.Header.Get("Content-Type"),
+	); mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		res.Status = http.StatusUnsupportedMediaType
+		return errors.New("unsupported media type, use text/plain")
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	targets, err := ParseWarmTargets(b)
+	if err != nil {
+		res.Status = http.StatusBadRequest
+		return err
+	}
+
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header.Set("Cache-Control", "no-store")
+
+	w := &warmProgressWriter{res: res}
+
+	subject, _ := req.Value(authSubjectKey).(string)
+	denied := 0
+	targets = slices.DeleteFunc(targets, func(wt WarmTarget) bool {
+		if err := authorizeWarmTarget(wt, subject); err != nil {
+			denied++
+			fmt.Fprintf(w, "%s: %v\n", wt.Module, err)
+			return true
+		}
+
+		return false
+	})
+
+	if err := WarmCache(req.Context, w, targets); err != nil {
+		fmt.Fprintln(w, err)
+	}
+
+	if denied > 0 {
+		fmt.Fprintf(w, "denied %d module versions\n", denied)
+	}
+
+	return nil
+}
+
+// authorizeWarmTarget authorizes the subject (empty if anonymous) to warm the
+// wt over HTTP. Private modules are never warmed over HTTP, as they are fetched
+// with the credentials of the Goproxy.
+func authorizeWarmTarget(wt WarmTarget, subject string) error {
+	if isPrivateModule(wt.Module.Path) {
+		return errors.New("private module")
+	}
+
+	if !authEnabled {
+		return nil
+	}
+
+	policy := matchAuthPolicy(wt.Module.Path)
+	switch {
+	case policy.Anonymous:
+	case subject == "":
+		return errors.New("unauthorized")
+	case len(policy.Subjects) > 0 &&
+		!slices.Contains(policy.Subjects, subject):
+		return errors.New("forbidden")
+	}
+
+	return nil
+}
+
+// warmProgressWriter implements the `io.Writer` to stream the progress of the
+// `hWarm`.
+type warmProgressWriter struct {
+	res *air.Response
+}
+
+// Write implements the `io.Writer`.
+func (wpw *warmProgressWriter) Write(b []byte) (int, error) {
+	n, err := wpw.res.HTTPResponseWriter().Write(b)
+	wpw.res.Flush()
+	return n, err
+}
+
+// WarmTarget is a module version to be warmed.
+type WarmTarget struct {
+	// Module is the module version. Its version can also be "latest".
+	Module module.Version
+
+	// ModOnly indicates whether only the ".info" and ".mod" files of the
+	// module version are warmed, as the go.sum files only have the hashes
+	// of the go.mod files of the module versions that are not built.
+	ModOnly bool
+}
+
+// ParseWarmTargets parses the b as a go.mod file, a go.sum file or a list of
+// module versions of the form "<module>@<version>" (one per line) and returns
+// the warm targets in it.
+func ParseWarmTargets(b []byte) ([]WarmTarget, error) {
+	var targets []WarmTarget
+	if f, err := modfile.ParseLax("go.mod", b, nil); err == nil &&
+		f.Module != nil {
+		for _, r := range f.Require {
+			targets = append(targets, WarmTarget{Module: r.Mod})
+		}
+
+		for _, r := range f.Replace {
+			if r.New.Version != "" {
+				targets = append(targets, WarmTarget{
+					Module: r.New,
+				})
+			}
+		}
+
+		return targets, nil
+	}
+
+	for line := range strings.Lines(string(b)) {
+		line, _, _ = strings.Cut(line, "#")
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 3 && strings.HasPrefix(fields[2], "h1:"):
+			version, modOnly := strings.CutSuffix(
+				fields[1],
+				"/go.mod",
+			)
+			targets = append(targets, WarmTarget{
+				Module: module.Version{
+					Path:    fields[0],
+					Version: version,
+				},
+				ModOnly: modOnly,
+			})
+		case len(fields) == 1 && strings.Contains(fields[0], "@"):
+			path, version, _ := strings.Cut(fields[0], "@")
+			targets = append(targets, WarmTarget{
+				Module: module.Version{
+					Path:    path,
+					Version: version,
+				},
+			})
+		default:
+			return nil, fmt.Errorf(
+				"invalid warm target: %q",
+				strings.TrimSpace(line),
+			)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no warm targets")
+	}
+
+	return targets, nil
+}
+
+// dedupWarmTargets returns the targets without duplicates. A module version
+// is only warmed as mod-only if all of its targets are.
+func dedupWarmTargets(targets []WarmTarget) []WarmTarget {
+	indexes := map[module.Version]int{}
+	deduped := make([]WarmTarget, 0, len(targets))
+	for _, wt := range targets {
+		if i, ok := indexes[wt.Module]; ok {
+			deduped[i].ModOnly = deduped[i].ModOnly && wt.ModOnly
+			continue
+		}
+
+		indexes[wt.Module] = len(deduped)
+		deduped = append(deduped, wt)
+	}
+
+	return deduped
+}
+
+// WarmCache caches the targets through the `hhGoproxy` with at most the
+// `warmConcurrency` targets at the same time, and writes the progress to the
+// w.
+func WarmCache(
+	ctx context.Context,
+	w io.Writer,
+	targets []WarmTarget,
+) error {
+	if err := prepareGoproxyPrivate(); err != nil {
+		return err
+	}
+
+	// The takedowns must be known before anything is fetched.
+	if err := loadStoredModuleRules(ctx); err != nil {
+		return fmt.Errorf("failed to load module rules: %w", err)
+	}
+
+	targets = dedupWarmTargets(targets)
+
+	var (
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, max(warmConcurrency, 1))
+		mutex     sync.Mutex
+		done      int
+		failed    int
+	)
+
+	for _, wt := range targets {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			resolved, err := warmModuleVersion(ctx, wt)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			done++
+			if err != nil {
+				failed++
+				fmt.Fprintf(
+					w,
+					"[%d/%d] %s: %v\n",
+					done,
+					len(targets),
+					wt.Module,
+					err,
+				)
+				return
+			}
+
+			fmt.Fprintf(
+				w,
+				"[%d/%d] %s: ok\n",
+				done,
+				len(targets),
+				resolved,
+			)
+		}()
+	}
+
+	wg.Wait()
+
+	fmt.Fprintf(w, "warmed %d, failed %d\n", done-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to warm %d module versions", failed)
+	}
+
+	return nil
+}
+
+// warmModuleVersion caches the wt through the `hhGoproxy`, and returns its
+// module version with the version resolved. It fails fast if the fetch budget
+// of the `rateLimitClient` in the ctx (if any) is used up.
+//
+// The module rules are checked before anything is fetched, as the
+// `fetchGoproxy` bypasses the `serveModuleRules`, and again once the version
+// is resolved.
+func warmModuleVersion(
+	ctx context.Context,
+	wt WarmTarget,
+) (module.Version, error) {
+	if err := checkWarmModuleRules(wt.Module.Path, ""); err != nil {
+		return module.Version{}, err
+	}
+
+	// The "latest" and the version queries are checked once resolved,
+	// as only the files of the resolved versions are cached.
+	if semver.IsValid(wt.Module.Version) {
+		if err := checkWarmModuleRules(
+			wt.Module.Path,
+			wt.Module.Version,
+		); err != nil {
+			return module.Version{}, err
+		}
+	}
+
+	if rlc := rateLimitClientFromContext(ctx); rlc != nil {
+		// Like the `serveRateLimit`, the "@latest" files always
+		// fetch, while the others only take the fetch tokens on cache
+		// misses.
+		n := 0
+		if wt.Module.Version == "latest" {
+			n = 1
+		}
+
+		if wait := rlc.take(ctx, rateLimitBudgetFetch, n); wait > 0 {
+			rateLimitedRequestsTotal.WithLabelValues(
+				rateLimitBudgetFetch,
+			).Inc()
+			return module.Version{}, fmt.Errorf(
+				"too many requests, retry after %s",
+				wait.Round(time.Second),
+			)
+		}
+	}
+
+	escapedModulePath, err := module.EscapePath(wt.Module.Path)
+	if err != nil {
+		return module.Version{}, err
+	}
+
+	nameVersionPrefix := fmt.Sprint(escapedModulePath, "/@v/")
+
+	infoName := escapedModulePath + "/@latest"
+	if wt.Module.Version != "latest" {
+		escapedModuleVersion, err := module.EscapeVersion(
+			wt.Module.Version,
+		)
+		if err != nil {
+			return module.Version{}, err
+		}
+
+		infoName = nameVersionPrefix + escapedModuleVersion + ".info"
+	}
+
+	info := fetchGoproxy(ctx, http.MethodGet, infoName)
+	if info.status != http.StatusOK {
+		return module.Version{}, goproxyResponseError(info)
+	}
+
+	var infoBody struct{ Version string }
+	if err := json.Unmarshal(info.body.Bytes(), &infoBody); err != nil {
+		return module.Version{}, err
+	}
+
+	resolved := module.Version{
+		Path:    wt.Module.Path,
+		Version: infoBody.Version,
+	}
+
+	if err := checkWarmModuleRules(
+		resolved.Path,
+		resolved.Version,
+	); err != nil {
+		return module.Version{}, err
+	}
+
+	escapedModuleVersion, err := module.EscapeVersion(resolved.Version)
+	if err != nil {
+		return module.Version{}, err
+	}
+
+	nameExts := []string{".info", ".mod", ".zip"}
+	if wt.ModOnly {
+		nameExts = nameExts[:2]
+	}
+
+	for _, nameExt := range nameExts {
+		grr := fetchGoproxy(
+			ctx,
+			http.MethodHead,
+			nameVersionPrefix+escapedModuleVersion+nameExt,
+		)
+		if grr.status != http.StatusOK {
+			return module.Version{}, goproxyResponseError(grr)
+		}
+	}
+
+	return resolved, nil
+}
+
+// checkWarmModuleRules returns an error if the module version (or the module
+// itself if the moduleVersion is empty) is denied by the module rules.
+func checkWarmModuleRules(modulePath, moduleVersion string) error {
+	switch mr := applyModuleRule(
+		moduleRules(),
+		modulePath,
+		moduleVersion,
+	); mr.Action {
+	case moduleRuleActionDeny, moduleRuleActionTakedown:
+		return fmt.Errorf("%s: %s", mr.Action, mr.Reason)
+	}
+
+	return nil
+}
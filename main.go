@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
@@ -13,23 +14,43 @@ import (
 	"github.com/air-gases/defibrillator"
 	"github.com/air-gases/langman"
 	"github.com/air-gases/limiter"
-	"github.com/air-gases/logger"
 	"github.com/aofei/air"
 	"github.com/goproxy/goproxy.cn/base"
 	"github.com/goproxy/goproxy.cn/handler"
+	"github.com/spf13/pflag"
 )
 
 func main() {
+	pflag.Parse()
+	if args := pflag.Args(); len(args) > 0 {
+		// The commands may leave temporary files behind, which must
+		// also be cleaned up when they are interrupted.
+		go func() {
+			signalChan := make(chan os.Signal, 1)
+			signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+			<-signalChan
+			handler.Cleanup()
+			os.Exit(1)
+		}()
+
+		err := runCommand(args)
+		handler.Cleanup()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	base.Air.NotFoundHandler = handler.NotFound
 	base.Air.MethodNotAllowedHandler = handler.MethodNotAllowed
 	base.Air.ErrorHandler = handler.Error
 	base.Air.ErrorLogger = log.New(base.Logger, "", 0)
 
 	base.Air.Pregases = []air.Gas{
-		logger.Gas(logger.GasConfig{
-			Logger:               &base.Logger,
-			IncludeClientAddress: true,
-		}),
+		handler.AccessLogGas,
+		handler.TracingGas,
 		defibrillator.Gas(defibrillator.GasConfig{}),
 		limiter.BodySizeGas(limiter.BodySizeGasConfig{
 			MaxBytes: 1 << 20,
@@ -56,6 +77,8 @@ func main() {
 		}),
 	}
 
+	handler.Start()
+
 	go func() {
 		if err := base.Air.Serve(); err != nil {
 			base.Logger.Error().Err(err).
@@ -67,8 +90,12 @@ func main() {
 	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
 	<-shutdownChan
 
+	handler.Drain()
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
 	base.Air.Shutdown(ctx)
+
+	handler.Cleanup()
 }